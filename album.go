@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gosalebot/bot"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// albumDebounce is how long to wait for more photos of the same album before
+// answering. Telegram delivers the photos of an album as separate updates in
+// quick succession.
+const albumDebounce = 1500 * time.Millisecond
+
+// albumAcks answers a whole album with one reply. The photos are stored as
+// their updates arrive; only the reply is held back, and each new photo of the
+// album replaces it and restarts the delay, so the reply that is finally sent
+// carries the final count.
+type albumAcks struct {
+	mu      sync.Mutex
+	sender  bot.Sender
+	delay   time.Duration
+	pending map[string]*pendingAck
+}
+
+type pendingAck struct {
+	chatID int64
+	msg    tgbotapi.MessageConfig
+	timer  *time.Timer
+}
+
+func newAlbumAcks(sender bot.Sender, delay time.Duration) *albumAcks {
+	return &albumAcks{sender: sender, delay: delay, pending: make(map[string]*pendingAck)}
+}
+
+// Add holds msg, the reply to one photo of album mediaGroupID, until the
+// album is complete. The reply quotes the album's first photo.
+func (a *albumAcks) Add(mediaGroupID string, msg tgbotapi.MessageConfig) {
+	key := fmt.Sprintf("%d:%s", msg.ChatID, mediaGroupID)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ack, ok := a.pending[key]; ok {
+		ack.timer.Stop()
+		msg.ReplyToMessageID = ack.msg.ReplyToMessageID
+	}
+	ack := &pendingAck{chatID: msg.ChatID, msg: msg}
+	ack.timer = time.AfterFunc(a.delay, func() { a.send(key, ack) })
+	a.pending[key] = ack
+}
+
+// send sends ack if it is still the reply held for key. A timer that fired
+// while a newer photo was replacing its reply finds another one held and
+// does nothing, so the album is answered once.
+func (a *albumAcks) send(key string, ack *pendingAck) {
+	a.mu.Lock()
+	if a.pending[key] != ack {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.pending, key)
+	a.mu.Unlock()
+	if _, err := a.sender.Send(ack.msg); err != nil {
+		log.Printf("[ERROR] Failed to acknowledge album in chat %d: %v", ack.chatID, err)
+	}
+}
+
+// Discard drops the replies still held for chatID, e.g. because the user
+// already moved on and the preview will show the photo count anyway.
+func (a *albumAcks) Discard(chatID int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, ack := range a.pending {
+		if ack.chatID == chatID {
+			ack.timer.Stop()
+			delete(a.pending, key)
+		}
+	}
+}
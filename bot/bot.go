@@ -8,13 +8,32 @@ import (
 	"gosalebot/i18n"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf16"
 
 	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
-	// tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// Sender is the part of the Telegram Bot API the bot logic needs.
+// *tgbotapi.BotAPI satisfies it; tests use the recorder in bot/bottest.
+type Sender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	SendMediaGroup(config tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error)
+}
+
+// maxAlbumSize is the most photos Telegram accepts in one media group.
+const maxAlbumSize = 10
+
+// maxCaptionLength is the most characters (UTF-16 code units, after parsing
+// the markup) Telegram accepts in a photo caption.
+const maxCaptionLength = 1024
+
+var _ Sender = (*tgbotapi.BotAPI)(nil)
+
 var adminIDs map[int64]struct{}
 
 func LoadAdminsFromEnv() {
@@ -31,24 +50,30 @@ func LoadAdminsFromEnv() {
 	}
 }
 
-func HandleMessageWithDB(dbConn *sql.DB, userID int64, text string, bot *tgbotapi.BotAPI, chatID int64, messageID int, photoFileIDs []string, moderationGroupID int64, lang string, username ...string) string {
-	// lang := "en" // In the future, detect or store user language
-	session, ok := fsm.Sessions[userID]
-	if !ok {
-		session = &fsm.UserSession{UserID: userID, State: fsm.StateIdle, PostData: make(map[string]interface{})}
-		fsm.Sessions[userID] = session
+func HandleMessageWithDB(dbConn *sql.DB, userID int64, text string, bot Sender, chatID int64, messageID int, newPhotos []fsm.Photo, moderationGroupID int64, lang string, username ...string) string {
+	session, created := fsm.GetOrCreate(userID)
+	if created {
 		log.Printf("[INFO] New session created for user %d", userID)
 	}
+	// Persist the session after every transition so drafts survive a restart
+	defer fsm.Save(session)
 
 	saveUsername := ""
 	if len(username) > 0 {
 		saveUsername = username[0]
 	}
 
+	// Outside a draft, commands in the groups are left to the groups
+	if chatID > 0 || session.State != fsm.StateIdle {
+		if resp, handled := handleGlobalCommand(session, text, lang); handled {
+			return resp
+		}
+	}
+
 	switch session.State {
 	case fsm.StateIdle:
 		if text == "/start" {
-			_, err := dbConn.Exec(`INSERT OR IGNORE INTO users (id, username) VALUES (?, ?)`, userID, saveUsername)
+			_, err := dbConn.Exec(`INSERT INTO users (id, username) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET username=excluded.username`, userID, saveUsername)
 			if err != nil {
 				log.Printf("[ERROR] Failed to insert user %d: %v", userID, err)
 			} else {
@@ -64,73 +89,114 @@ func HandleMessageWithDB(dbConn *sql.DB, userID int64, text string, bot *tgbotap
 		log.Printf("[WARNING] Ignored message from user %d in group/channel", userID)
 		return ""
 	case fsm.StateTitle:
-		log.Printf("[INFO] User %d entered title: %s", userID, text)
-		session.PostData["title"] = text
-		session.State = fsm.StateDescription
-		return i18n.T(lang, "enter_description")
+		title, problem := validateField(dbConn, "title", text, newPhotos, lang)
+		if problem != "" {
+			log.Printf("[INFO] User %d sent an invalid title: %q", userID, text)
+			return problem
+		}
+		log.Printf("[INFO] User %d entered title: %s", userID, title)
+		session.PostData["title"] = title
+		return advance(session, fsm.StateDescription, lang, "enter_description")
 	case fsm.StateDescription:
-		log.Printf("[INFO] User %d entered description: %s", userID, text)
-		session.PostData["description"] = text
-		session.State = fsm.StatePrice
-		return i18n.T(lang, "enter_price")
+		description, problem := validateField(dbConn, "description", text, newPhotos, lang)
+		if problem != "" {
+			log.Printf("[INFO] User %d sent an invalid description: %q", userID, text)
+			return problem
+		}
+		log.Printf("[INFO] User %d entered description: %s", userID, description)
+		session.PostData["description"] = description
+		return advance(session, fsm.StatePrice, lang, "enter_price")
 	case fsm.StatePrice:
-		log.Printf("[INFO] User %d entered price: %s", userID, text)
-		session.PostData["price"] = text
-		session.State = fsm.StateLocation
-		return i18n.T(lang, "enter_location")
+		priceText, problem := validateField(dbConn, "price", text, newPhotos, lang)
+		if problem != "" {
+			log.Printf("[INFO] User %d sent an invalid price: %q", userID, text)
+			return problem
+		}
+		log.Printf("[INFO] User %d entered price: %s", userID, priceText)
+		price, ok := ParsePrice(priceText, defaultCurrency(dbConn))
+		if !ok {
+			return i18n.T(lang, "invalid_price")
+		}
+		session.PostData["price"] = priceText
+		session.PostData["price_kind"] = price.Kind
+		if price.Kind == PriceFixed {
+			session.PostData["price_amount"] = price.Amount
+			session.PostData["price_currency"] = price.Currency
+		} else {
+			delete(session.PostData, "price_amount")
+			delete(session.PostData, "price_currency")
+		}
+		return advance(session, fsm.StateLocation, lang, "enter_location")
 	case fsm.StateLocation:
-		log.Printf("[INFO] User %d entered location: %s", userID, text)
-		session.PostData["location"] = text
-		session.State = fsm.StatePhotos
-		return i18n.T(lang, "send_photos")
+		location, problem := validateField(dbConn, "location", text, newPhotos, lang)
+		if problem != "" {
+			log.Printf("[INFO] User %d sent an invalid location: %q", userID, text)
+			return problem
+		}
+		log.Printf("[INFO] User %d entered location: %s", userID, location)
+		session.PostData["location"] = location
+		return advance(session, fsm.StatePhotos, lang, "send_photos")
 	case fsm.StatePhotos:
-		if len(photoFileIDs) > 0 {
-			log.Printf("[INFO] User %d sent %d photo(s)", userID, len(photoFileIDs))
-			var photos []string
-			if existingPhotos, ok := session.PostData["photos"].([]string); ok {
-				photos = existingPhotos
-			} else {
-				photos = []string{}
+		if len(newPhotos) > 0 {
+			log.Printf("[INFO] User %d sent %d photo(s)", userID, len(newPhotos))
+			delete(session.PostData, fsm.PhotosBeforeEdit)
+			photos := sessionPhotos(session)
+			added := 0
+			maxPhotos := db.MaxPhotos(dbConn)
+			for _, photo := range newPhotos {
+				if hasPhoto(photos, photo) {
+					log.Printf("[INFO] User %d sent photo %s twice, skipping it", userID, photo.FileUniqueID)
+					continue
+				}
+				if len(photos) >= maxPhotos {
+					log.Printf("[INFO] User %d exceeded the limit of %d photos", userID, maxPhotos)
+					session.PostData["photos"] = photos
+					return i18n.T(lang, "photo_limit_reached", i18n.Args{"max": maxPhotos})
+				}
+				photos = append(photos, photo)
+				added++
 			}
-			photos = append(photos, photoFileIDs...)
 			session.PostData["photos"] = photos
-			return i18n.T(lang, "photo_received")
+			if added == 0 {
+				return i18n.T(lang, "photo_duplicate")
+			}
+			return i18n.T(lang, "photo_received", i18n.Args{"count": len(photos)})
 		}
 		if text == "done" {
-			title := session.PostData["title"]
-			description := session.PostData["description"]
-			price := session.PostData["price"]
-			location := session.PostData["location"]
-			photos, _ := session.PostData["photos"].([]string)
-			res, err := dbConn.Exec(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at) VALUES (?, ?, ?, 'pending', ?, ?, ?, ?, datetime('now'), datetime('now', '+1 day'))`,
-				userID, chatID, messageID, title, description, price, location)
-			if err != nil {
-				log.Printf("[ERROR] Failed to insert post: %v", err)
-				return i18n.T(lang, "failed_save")
+			log.Printf("[INFO] User %d finished photos, showing preview", userID)
+			delete(session.PostData, fsm.PhotosBeforeEdit)
+			sendPreviewAlbum(bot, chatID, session)
+			return showPreview(session, lang)
+		}
+		log.Printf("[WARNING] User %d sent invalid input in photo state: %s", userID, text)
+		return i18n.T(lang, "send_photo_or_done")
+	case fsm.StatePreview:
+		if text == "confirm" {
+			if isListingEdit(session) {
+				return submitListingEdit(dbConn, bot, session, moderationGroupID, lang)
 			}
-			postID, _ := res.LastInsertId()
-			for _, fileID := range photos {
-				_, err := dbConn.Exec(`INSERT INTO photos (post_id, file_id) VALUES (?, ?)`, postID, fileID)
-				if err != nil {
-					log.Printf("[ERROR] Failed to insert photo: %v", err)
+			return submitPost(dbConn, bot, session, chatID, messageID, moderationGroupID, lang)
+		}
+		if field, ok := strings.CutPrefix(text, "edit:"); ok {
+			// The photos of a published listing stay as they are
+			if step, ok := stepForField(field); ok && !(field == "photos" && isListingEdit(session)) {
+				log.Printf("[INFO] User %d is editing %s from preview", userID, field)
+				session.State = step.state
+				session.Editing = true
+				if field == "photos" {
+					// Kept aside until the first new photo, in case of /back
+					session.PostData[fsm.PhotosBeforeEdit] = sessionPhotos(session)
+					delete(session.PostData, "photos")
 				}
+				return i18n.T(lang, step.prompt)
 			}
-			log.Printf("[INFO] Post submitted by user %d (postID: %d) for moderation", userID, postID)
-			moderationMsg := i18n.T(lang, "moderation_preview", title, description, price, location)
-			msg := tgbotapi.NewMessage(moderationGroupID, moderationMsg)
-			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-				tgbotapi.NewInlineKeyboardRow(
-					tgbotapi.NewInlineKeyboardButtonData("✅ Approve", "approve"),
-					tgbotapi.NewInlineKeyboardButtonData("❌ Reject", "reject"),
-				),
-			)
-			_, _ = bot.Send(msg)
-			session.State = fsm.StateIdle
-			session.PostData = make(map[string]interface{})
-			return i18n.T(lang, "post_submitted")
 		}
-		log.Printf("[WARNING] User %d sent invalid input in photo state: %s", userID, text)
-		return i18n.T(lang, "send_photo_or_done")
+		if text == "cancel" {
+			log.Printf("[INFO] User %d cancelled their post", userID)
+			return cancelDraft(session, lang)
+		}
+		log.Printf("[WARNING] User %d sent invalid input in preview state: %s", userID, text)
+		return i18n.T(lang, "send_confirm_or_cancel")
 	default:
 		log.Printf("[WARNING] Session reset for user %d due to unknown state", userID)
 		session.State = fsm.StateIdle
@@ -138,133 +204,557 @@ func HandleMessageWithDB(dbConn *sql.DB, userID int64, text string, bot *tgbotap
 	}
 }
 
-func ApprovePost(dbConn *sql.DB, bot *tgbotapi.BotAPI, moderationMsg *tgbotapi.Message, approvedGroupID int64) error {
-	// Find the post by matching the moderation message text (could be improved with DB linkage)
-	// For demo, extract title from message and find post
-	title := extractTitleFromModerationMsg(moderationMsg.Text)
-	row := dbConn.QueryRow("SELECT id, user_id, description, price, location FROM posts WHERE title = ? AND status = 'pending' ORDER BY created_at DESC LIMIT 1", title)
-	var postID, userID int64
-	var description, price, location string
-	err := row.Scan(&postID, &userID, &description, &price, &location)
+// wizardStep is a field of the wizard, the state that collects it and the
+// prompt that asks for it.
+type wizardStep struct {
+	field  string
+	state  int
+	prompt string
+}
+
+// wizardSteps lists the wizard fields in the order they are asked for.
+var wizardSteps = []wizardStep{
+	{"title", fsm.StateTitle, "enter_title"},
+	{"description", fsm.StateDescription, "enter_description"},
+	{"price", fsm.StatePrice, "enter_price"},
+	{"location", fsm.StateLocation, "enter_location"},
+	{"photos", fsm.StatePhotos, "send_photos"},
+}
+
+// stepForField finds the step that collects field, for the "edit:<field>"
+// preview buttons.
+func stepForField(field string) (wizardStep, bool) {
+	for _, step := range wizardSteps {
+		if step.field == field {
+			return step, true
+		}
+	}
+	return wizardStep{}, false
+}
+
+// previousStep returns the step /back should return to from state. The
+// first field has nothing before it, so it returns to itself; the preview
+// returns to the last field.
+func previousStep(state int) (wizardStep, bool) {
+	if state == fsm.StatePreview {
+		return wizardSteps[len(wizardSteps)-1], true
+	}
+	for i, step := range wizardSteps {
+		if step.state == state {
+			return wizardSteps[max(i-1, 0)], true
+		}
+	}
+	return wizardStep{}, false
+}
+
+// promptWithCurrent asks for step again, showing what the draft holds now.
+func promptWithCurrent(session *fsm.UserSession, step wizardStep, lang string) string {
+	prompt := i18n.T(lang, step.prompt)
+	if step.field == "photos" {
+		return prompt + "\n" + i18n.T(lang, "current_photos", i18n.Args{"count": len(sessionPhotos(session))})
+	}
+	if current, ok := session.PostData[step.field].(string); ok {
+		return prompt + "\n" + i18n.T(lang, "current_value", i18n.Args{"value": current})
+	}
+	return prompt
+}
+
+// handleGlobalCommand handles the commands that work in every wizard state.
+// handled is false if text is not one of them.
+func handleGlobalCommand(session *fsm.UserSession, text, lang string) (resp string, handled bool) {
+	switch text {
+	case "/cancel":
+		if session.State == fsm.StateIdle {
+			return i18n.T(lang, "nothing_to_cancel"), true
+		}
+		log.Printf("[INFO] User %d cancelled their draft with /cancel", session.UserID)
+		return cancelDraft(session, lang), true
+	case "/back":
+		if session.Editing || (session.State == fsm.StatePreview && isListingEdit(session)) {
+			// Going back while editing one field abandons the edit; a
+			// published listing has no photo step to go back to
+			if photos, ok := session.PostData[fsm.PhotosBeforeEdit]; ok {
+				session.PostData["photos"] = photos
+				delete(session.PostData, fsm.PhotosBeforeEdit)
+			}
+			return showPreview(session, lang), true
+		}
+		step, ok := previousStep(session.State)
+		if !ok {
+			return i18n.T(lang, "start"), true
+		}
+		log.Printf("[INFO] User %d went back to %s", session.UserID, step.field)
+		session.State = step.state
+		return promptWithCurrent(session, step, lang), true
+	}
+	return "", false
+}
+
+// cancelDraft drops the draft, or the changes to a published listing.
+func cancelDraft(session *fsm.UserSession, lang string) string {
+	key := "post_cancelled"
+	if isListingEdit(session) {
+		key = "listing_edit_cancelled"
+	}
+	resetSession(session)
+	return i18n.T(lang, key)
+}
+
+// advance moves the wizard on to next and returns its prompt. When the user is
+// editing a single field from the preview, it goes straight back to the
+// preview instead.
+func advance(session *fsm.UserSession, next int, lang, prompt string) string {
+	if session.Editing {
+		return showPreview(session, lang)
+	}
+	session.State = next
+	return i18n.T(lang, prompt)
+}
+
+// showPreview moves the session to the preview step and returns the preview text.
+func showPreview(session *fsm.UserSession, lang string) string {
+	session.State = fsm.StatePreview
+	session.Editing = false
+	return previewText(lang, session)
+}
+
+// PreviewKeyboard is shown under the preview so the user can submit or
+// discard the draft, or go back and change a single field.
+func PreviewKeyboard(lang string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_confirm"), "confirm"),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_cancel"), "cancel"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_title"), "edit:title"),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_description"), "edit:description"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_price"), "edit:price"),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_location"), "edit:location"),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_photos"), "edit:photos"),
+		),
+	)
+}
+
+// StateKeyboard returns the inline keyboard that belongs under a reply sent
+// in state, labelled in lang, or nil if the state has none.
+func StateKeyboard(state int, lang string) *tgbotapi.InlineKeyboardMarkup {
+	switch state {
+	case fsm.StatePreview:
+		markup := PreviewKeyboard(lang)
+		return &markup
+	case fsm.StatePhotos:
+		markup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_done"), "done"),
+		))
+		return &markup
+	}
+	return nil
+}
+
+func sessionPhotos(session *fsm.UserSession) []fsm.Photo {
+	photos, _ := session.PostData["photos"].([]fsm.Photo)
+	return photos
+}
+
+// hasPhoto reports whether photos already holds photo, judged by Telegram's
+// file_unique_id, which is the same however often a file is sent.
+func hasPhoto(photos []fsm.Photo, photo fsm.Photo) bool {
+	for _, p := range photos {
+		if p.FileID == photo.FileID || (photo.FileUniqueID != "" && p.FileUniqueID == photo.FileUniqueID) {
+			return true
+		}
+	}
+	return false
+}
+
+func previewText(lang string, session *fsm.UserSession) string {
+	return i18n.T(lang, "preview", i18n.Args{
+		"title":       session.PostData["title"],
+		"description": session.PostData["description"],
+		"price":       draftPrice(lang, session.PostData),
+		"location":    session.PostData["location"],
+		"photos":      len(sessionPhotos(session)),
+	})
+}
+
+// sendPreviewAlbum shows the user the photos of their draft before the
+// preview text, so they can check them before confirming.
+func sendPreviewAlbum(bot Sender, chatID int64, session *fsm.UserSession) {
+	photos := sessionPhotos(session)
+	if len(photos) == 0 {
+		return
+	}
+	if _, err := sendAlbum(bot, chatID, 0, photos, ""); err != nil {
+		log.Printf("[WARNING] Failed to send preview photos to user %d: %v", session.UserID, err)
+	}
+}
+
+// sendAlbum sends photos to chatID as media groups of up to maxAlbumSize
+// photos. Telegram rejects single-item groups, so a lone photo is sent as a
+// plain photo message, and it doesn't mix photos and documents in one group,
+// so images sent as files follow in groups of their own. A non-empty caption,
+// in MarkdownV2, goes on the first photo, which Telegram shows as the caption
+// of the whole album.
+func sendAlbum(bot Sender, chatID int64, threadID int, photos []fsm.Photo, caption string) ([]tgbotapi.Message, error) {
+	var pictures, documents []fsm.Photo
+	for _, photo := range photos {
+		if photo.Document {
+			documents = append(documents, photo)
+		} else {
+			pictures = append(pictures, photo)
+		}
+	}
+	var sent []tgbotapi.Message
+	for _, kind := range [][]fsm.Photo{pictures, documents} {
+		for start := 0; start < len(kind); start += maxAlbumSize {
+			chunk := kind[start:min(start+maxAlbumSize, len(kind))]
+			msgs, err := sendAlbumChunk(bot, chatID, threadID, chunk, caption)
+			sent = append(sent, msgs...)
+			if err != nil {
+				return sent, err
+			}
+			caption = ""
+		}
+	}
+	return sent, nil
+}
+
+// sendAlbumChunk sends up to maxAlbumSize photos of the same kind.
+func sendAlbumChunk(bot Sender, chatID int64, threadID int, chunk []fsm.Photo, caption string) ([]tgbotapi.Message, error) {
+	parseMode := ""
+	if caption != "" {
+		parseMode = "MarkdownV2"
+	}
+	if len(chunk) == 1 {
+		var single tgbotapi.Chattable
+		file := tgbotapi.FileID(chunk[0].FileID)
+		if chunk[0].Document {
+			doc := tgbotapi.NewDocument(chatID, file)
+			doc.MessageThreadID, doc.Caption, doc.ParseMode = threadID, caption, parseMode
+			single = doc
+		} else {
+			photo := tgbotapi.NewPhoto(chatID, file)
+			photo.MessageThreadID, photo.Caption, photo.ParseMode = threadID, caption, parseMode
+			single = photo
+		}
+		msg, err := bot.Send(single)
+		if err != nil {
+			return nil, err
+		}
+		return []tgbotapi.Message{msg}, nil
+	}
+	media := make([]interface{}, 0, len(chunk))
+	for i, photo := range chunk {
+		file := tgbotapi.FileID(photo.FileID)
+		if photo.Document {
+			item := tgbotapi.NewInputMediaDocument(file)
+			if i == 0 {
+				item.Caption, item.ParseMode = caption, parseMode
+			}
+			media = append(media, item)
+		} else {
+			item := tgbotapi.NewInputMediaPhoto(file)
+			if i == 0 {
+				item.Caption, item.ParseMode = caption, parseMode
+			}
+			media = append(media, item)
+		}
+	}
+	group := tgbotapi.NewMediaGroup(chatID, media)
+	group.MessageThreadID = threadID
+	return bot.SendMediaGroup(group)
+}
+
+// submitPost saves the confirmed draft and sends it to the moderation group.
+func submitPost(dbConn *sql.DB, bot Sender, session *fsm.UserSession, chatID int64, messageID int, moderationGroupID int64, lang string) string {
+	userID := session.UserID
+	session.PostData["chat_id"] = chatID
+	session.PostData["message_id"] = messageID
+	postID, err := db.SavePostToDB(dbConn, userID, session.PostData)
 	if err != nil {
-		log.Printf("[ERROR] ApprovePost: failed to find post for title '%s': %v", title, err)
-		return err
+		log.Printf("[ERROR] Failed to insert post: %v", err)
+		return i18n.T(lang, "failed_save")
 	}
-	_, err = dbConn.Exec("UPDATE posts SET status = 'approved' WHERE id = ?", postID)
+	log.Printf("[INFO] Post submitted by user %d (postID: %d) for moderation", userID, postID)
+	session.State = fsm.StateIdle
+	postData := session.PostData
+	session.PostData = make(map[string]interface{})
+
+	photos, _ := postData["photos"].([]fsm.Photo)
+	if err := sendForModeration(dbConn, bot, postID, moderationGroupID, moderationText(dbConn, postID, postData), photos); err != nil {
+		return i18n.T(lang, "post_saved_failed_forward")
+	}
+	return i18n.T(lang, "post_submitted")
+}
+
+// moderationText is what moderators read about a post, with a warning when
+// its photos are also used in other posts.
+func moderationText(dbConn *sql.DB, postID int64, postData map[string]interface{}) string {
+	// Like the buttons, the preview is in the group's language, not the seller's
+	lang := DefaultLang()
+	text := i18n.T(lang, "moderation_preview", i18n.Args{
+		"title":       postData["title"],
+		"description": postData["description"],
+		"price":       draftPrice(lang, postData),
+		"location":    postData["location"],
+	})
+	if dups, err := db.DuplicatePhotoPosts(dbConn, postID); err == nil && len(dups) > 0 {
+		refs := make([]string, 0, len(dups))
+		for _, id := range dups {
+			refs = append(refs, fmt.Sprintf("#%d", id))
+		}
+		text += "\n" + i18n.T(lang, "moderation_duplicate_photos", i18n.Args{"count": len(dups), "posts": strings.Join(refs, ", ")})
+	}
+	return text
+}
+
+// sendForModeration sends a post to the moderation group and records the
+// messages it was sent as.
+func sendForModeration(dbConn *sql.DB, bot Sender, postID, moderationGroupID int64, text string, photos []fsm.Photo) error {
+	// Moderators see the photos as an album, with the text and the
+	// Approve/Reject keyboard in a reply to it
+	album, err := sendAlbum(bot, moderationGroupID, 0, photos, "")
 	if err != nil {
-		log.Printf("[ERROR] ApprovePost: failed to update status: %v", err)
-		return err
+		log.Printf("[WARNING] Failed to send photos of post %d to moderation: %v", postID, err)
 	}
-	lang := os.Getenv("LANG")
-	if lang == "" {
-		lang = "en"
+	msg := tgbotapi.NewMessage(moderationGroupID, text)
+	msg.ReplyMarkup = moderationKeyboard(postID)
+	if len(album) > 0 {
+		msg.ReplyToMessageID = album[0].MessageID
+		msg.AllowSendingWithoutReply = true
 	}
-	// Find the username from the DB
-	var username string
-	row = dbConn.QueryRow("SELECT username FROM users WHERE id = ?", userID)
-	err = row.Scan(&username)
+	sent, err := bot.Send(msg)
 	if err != nil {
-		log.Printf("[WARNING] ApprovePost: failed to find username for userID '%d': %v", userID, err)
-	}
-	// Compose a new message for the approved group
-	var postedBy string
-	if username != "" {
-		// Only allow safe Telegram usernames (alphanumeric and underscores)
-		if isSafeUsername(username) {
-			postedBy = "@" + username
-		} else {
-			postedBy = fmt.Sprintf("[user](tg://user?id=%d)", userID)
+		log.Printf("[ERROR] Failed to send post %d to moderation: %v", postID, err)
+		// Don't leave an orphaned album behind
+		for _, m := range album {
+			deleteMessage(bot, "sendForModeration", m.Chat.ID, m.MessageID)
 		}
-	} else {
-		postedBy = fmt.Sprintf("[user](tg://user?id=%d)", userID)
+		return err
 	}
-	msgText := escapeMarkdown(i18n.T(lang, "for_sale", title, description, price, location, postedBy))
-	msg := tgbotapi.NewMessage(approvedGroupID, msgText)
-	msg.ParseMode = "MarkdownV2"
+	if err := db.SetModerationMessage(dbConn, postID, sent.Chat.ID, sent.MessageID); err != nil {
+		log.Printf("[ERROR] Failed to link post %d to moderation message: %v", postID, err)
+	}
+	bundle := make([]db.MessageRef, 0, len(album)+1)
+	for _, m := range append(album, sent) {
+		bundle = append(bundle, db.MessageRef{ChatID: m.Chat.ID, MessageID: m.MessageID})
+	}
+	if err := db.AddModerationMessages(dbConn, postID, bundle); err != nil {
+		log.Printf("[ERROR] Failed to record moderation messages of post %d: %v", postID, err)
+	}
+	return nil
+}
+
+// moderationKeyboard builds the Approve/Reject buttons for a post. The post ID
+// is carried in the callback data so the buttons always act on that post.
+func moderationKeyboard(postID int64) tgbotapi.InlineKeyboardMarkup {
+	lang := DefaultLang()
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_approve"), fmt.Sprintf("approve:%d", postID)),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_reject"), fmt.Sprintf("reject:%d", postID)),
+		),
+	)
+}
+
+// ParseModerationCallback splits callback data such as "approve:42" into the
+// action and the post ID.
+func ParseModerationCallback(data string) (action string, postID int64, ok bool) {
+	return parsePostCallback(data, "approve", "reject")
+}
+
+// parsePostCallback splits callback data of the form "<action>:<post ID>",
+// accepting only the given actions.
+func parsePostCallback(data string, actions ...string) (action string, postID int64, ok bool) {
+	action, idStr, found := strings.Cut(data, ":")
+	if !found || !slices.Contains(actions, action) {
+		return "", 0, false
+	}
+	postID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return action, postID, true
+}
+
+// ApprovePost publishes a pending post in the sale group. The post only
+// becomes approved, together with the record of its published messages,
+// once it was sent; if sending fails it stays pending for another try.
+func ApprovePost(dbConn *sql.DB, bot Sender, postID int64, approvedGroupID int64) error {
+	l, err := loadListing(dbConn, postID)
+	if err == nil && l.status != "pending" {
+		err = ErrPostNotPending
+	}
+	if err != nil {
+		log.Printf("[ERROR] ApprovePost: failed to find pending post %d: %v", postID, err)
+		return err
+	}
+	published, err := sendListing(dbConn, bot, l, approvedGroupID)
+	if err != nil {
+		log.Printf("[ERROR] ApprovePost: failed to send approved post: %v", err)
+		deletePublished(bot, "ApprovePost", published)
+		return err
+	}
+	if err := db.PublishPost(dbConn, postID, published, time.Now()); err != nil {
+		// Another moderator was faster, or the listing can't be tracked;
+		// either way it must not stay in the sale group
+		log.Printf("[ERROR] ApprovePost: failed to mark post %d approved: %v", postID, err)
+		deletePublished(bot, "ApprovePost", published)
+		return err
+	}
+	deleteModerationMessages(dbConn, bot, "ApprovePost", postID)
+	log.Printf("[INFO] Post %d approved and published by admin", postID)
+	return nil
+}
+
+// sendListing publishes l in the sale group, in the configured topic, and
+// returns the messages sent, even when only some of them went out.
+func sendListing(dbConn *sql.DB, bot Sender, l listing, approvedGroupID int64) ([]db.PublishedMessage, error) {
+	// The sale group reads the deployment language, not the seller's
+	text := listingText(dbConn, DefaultLang(), l, "approved")
 	// If a topic ID is provided in config, set it
 	topicIDStr, err := db.GetConfig(dbConn, "APPROVED_TOPIC_ID")
 	var topicID int
 	if err == nil && topicIDStr != "" {
 		topicID, err = strconv.Atoi(topicIDStr)
-		if err == nil {
-			msg.MessageThreadID = topicID
+		if err != nil {
+			topicID = 0
 		}
 	}
-	_, err = bot.Send(msg)
+	photos, err := db.GetPhotos(dbConn, l.id)
 	if err != nil {
-		log.Printf("[ERROR] ApprovePost: failed to send approved post: %v", err)
-		return err
+		log.Printf("[WARNING] sendListing: failed to query photos: %v", err)
 	}
-	// Forward photos
-	rows, err := dbConn.Query("SELECT file_id FROM photos WHERE post_id = ?", postID)
-	if err != nil {
-		log.Printf("[WARNING] ApprovePost: failed to query photos: %v", err)
-	} else {
-		defer rows.Close()
-		for rows.Next() {
-			var fileID string
-			if err := rows.Scan(&fileID); err == nil {
-				photoMsg := tgbotapi.NewPhoto(approvedGroupID, tgbotapi.FileID(fileID))
-				photoMsg.Caption = "Approved post photo"
-				if topicID != 0 {
-					photoMsg.MessageThreadID = topicID
-				}
-				_, sendErr := bot.Send(photoMsg)
-				if sendErr != nil {
-					log.Printf("[WARNING] ApprovePost: failed to send photo: %v", sendErr)
-				}
-			} else {
-				log.Printf("[WARNING] ApprovePost: failed to scan photo: %v", err)
-			}
-		}
-	}
-	// Delete moderation message
-	deleteMsg := tgbotapi.NewDeleteMessage(moderationMsg.Chat.ID, moderationMsg.MessageID)
-	_, delErr := bot.Request(deleteMsg)
-	if delErr != nil {
-		log.Printf("[WARNING] ApprovePost: failed to delete moderation message: %v", delErr)
+	return publishListing(bot, approvedGroupID, topicID, listingMarkdown(dbConn, DefaultLang(), l, "approved"), captionFits(text), photos)
+}
+
+// deletePublished removes published messages from the sale group.
+func deletePublished(bot Sender, caller string, published []db.PublishedMessage) {
+	for _, m := range published {
+		deleteMessage(bot, caller, m.ChatID, m.MessageID)
 	}
-	log.Printf("[INFO] Post %d approved and published by admin", postID)
-	return nil
 }
 
-func RejectPost(dbConn *sql.DB, bot *tgbotapi.BotAPI, moderationMsg *tgbotapi.Message, replyText string) error {
-	title := extractTitleFromModerationMsg(moderationMsg.Text)
-	row := dbConn.QueryRow("SELECT id, user_id FROM posts WHERE title = ? AND status = 'pending' ORDER BY created_at DESC LIMIT 1", title)
-	var postID, userID int64
-	err := row.Scan(&postID, &userID)
+// RejectPost rejects a pending post and tells the seller why. An empty
+// replyText gives the generic reason, translated for the seller.
+func RejectPost(dbConn *sql.DB, bot Sender, postID int64, replyText string) error {
+	row := dbConn.QueryRow("SELECT user_id FROM posts WHERE id = ? AND status = 'pending'", postID)
+	var userID int64
+	err := row.Scan(&userID)
 	if err != nil {
-		log.Printf("[ERROR] RejectPost: failed to find post for title '%s': %v", title, err)
+		log.Printf("[ERROR] RejectPost: failed to find pending post %d: %v", postID, err)
 		return err
 	}
-	_, err = dbConn.Exec("UPDATE posts SET status = 'rejected' WHERE id = ?", postID)
+	err = markPost(dbConn, postID, "rejected")
 	if err != nil {
 		log.Printf("[ERROR] RejectPost: failed to update status: %v", err)
 		return err
 	}
-	msg := tgbotapi.NewMessage(userID, "Your post was rejected: "+replyText)
+	lang := UserLang(dbConn, userID, "")
+	if replyText == "" {
+		replyText = i18n.T(lang, "rejected_by_admin")
+	}
+	msg := tgbotapi.NewMessage(userID, i18n.T(lang, "post_rejected", i18n.Args{"reason": replyText}))
 	_, sendErr := bot.Send(msg)
 	if sendErr != nil {
 		log.Printf("[WARNING] RejectPost: failed to notify user: %v", sendErr)
 	}
-	// Delete moderation message
-	deleteMsg := tgbotapi.NewDeleteMessage(moderationMsg.Chat.ID, moderationMsg.MessageID)
-	_, delErr := bot.Request(deleteMsg)
-	if delErr != nil {
-		log.Printf("[WARNING] RejectPost: failed to delete moderation message: %v", delErr)
-	}
+	deleteModerationMessages(dbConn, bot, "RejectPost", postID)
 	log.Printf("[INFO] Post %d rejected by admin", postID)
 	return nil
 }
 
-func extractTitleFromModerationMsg(text string) string {
-	// Assumes the title is on the line starting with "Title: "
-	for _, line := range strings.Split(text, "\n") {
-		if strings.HasPrefix(line, "Title: ") {
-			return strings.TrimPrefix(line, "Title: ")
+// publishListing posts a listing to the sale group: one album with the text
+// as its caption, or, when the text is too long for a caption or there are
+// no photos, the text followed by an uncaptioned album. It returns the
+// messages sent.
+func publishListing(bot Sender, chatID int64, threadID int, text string, asCaption bool, photos []fsm.Photo) ([]db.PublishedMessage, error) {
+	if len(photos) > 0 && asCaption {
+		album, err := sendAlbum(bot, chatID, threadID, photos, text)
+		return publishedMessages(album, db.PublishedCaption, threadID), err
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "MarkdownV2"
+	msg.MessageThreadID = threadID
+	sent, err := bot.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	album, err := sendAlbum(bot, chatID, threadID, photos, "")
+	if err != nil {
+		log.Printf("[WARNING] publishListing: failed to send photos: %v", err)
+	}
+	published := publishedMessages([]tgbotapi.Message{sent}, db.PublishedText, threadID)
+	return append(published, publishedMessages(album, db.PublishedPhoto, threadID)...), nil
+}
+
+// publishedMessages describes msgs, sent to topic threadID, for the
+// published_messages table. The first message is of kind first, the rest
+// are photos.
+func publishedMessages(msgs []tgbotapi.Message, first string, threadID int) []db.PublishedMessage {
+	published := make([]db.PublishedMessage, 0, len(msgs))
+	for i, m := range msgs {
+		kind := db.PublishedPhoto
+		if i == 0 {
+			kind = first
 		}
+		published = append(published, db.PublishedMessage{MessageRef: db.MessageRef{ChatID: m.Chat.ID, MessageID: m.MessageID}, ThreadID: threadID, Kind: kind})
+	}
+	return published
+}
+
+// captionFits reports whether text, before Markdown escaping, is short enough
+// to be a photo caption. Telegram counts UTF-16 code units.
+func captionFits(text string) bool {
+	return len(utf16.Encode([]rune(text))) <= maxCaptionLength
+}
+
+// ErrPostNotPending is returned when a post was already moderated, e.g. by
+// another moderator in the meantime.
+var ErrPostNotPending = db.ErrPostNotPending
+
+// markPost moves a pending post to status. The status check is part of the
+// UPDATE so two concurrent moderation actions can't both succeed.
+func markPost(dbConn *sql.DB, postID int64, status string) error {
+	res, err := dbConn.Exec("UPDATE posts SET status = ? WHERE id = ? AND status = 'pending'", status, postID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPostNotPending
+	}
+	return nil
+}
+
+// deleteModerationMessages removes every message of a post's moderation
+// bundle: the photo album and the message with the keyboard.
+func deleteModerationMessages(dbConn *sql.DB, bot Sender, caller string, postID int64) {
+	refs, err := db.GetModerationMessages(dbConn, postID)
+	if err != nil {
+		log.Printf("[WARNING] %s: failed to look up moderation messages of post %d: %v", caller, postID, err)
+		return
+	}
+	if len(refs) == 0 {
+		log.Printf("[WARNING] %s: post %d has no linked moderation message", caller, postID)
+		return
+	}
+	for _, ref := range refs {
+		deleteMessage(bot, caller, ref.ChatID, ref.MessageID)
+	}
+}
+
+func deleteMessage(bot Sender, caller string, chatID int64, messageID int) {
+	_, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID))
+	if err != nil {
+		log.Printf("[WARNING] %s: failed to delete message %d: %v", caller, messageID, err)
 	}
-	return ""
 }
 
 func IsAdmin(userID int64) bool {
@@ -272,10 +762,13 @@ func IsAdmin(userID int64) bool {
 	return ok
 }
 
+// HandleAdminCommand runs /config and /pending and returns the reply, in the
+// admin's own language.
 func HandleAdminCommand(dbConn *sql.DB, userID int64, text string) string {
+	lang := UserLang(dbConn, userID, "")
 	if !IsAdmin(userID) {
 		log.Printf("[WARNING] Unauthorized admin command attempt by user %d", userID)
-		return "You are not authorized to use this command."
+		return i18n.T(lang, "admin_unauthorized")
 	}
 	if strings.HasPrefix(text, "/config ") {
 		parts := strings.SplitN(text, " ", 3)
@@ -284,19 +777,19 @@ func HandleAdminCommand(dbConn *sql.DB, userID int64, text string) string {
 			err := db.SetConfig(dbConn, key, value)
 			if err != nil {
 				log.Printf("[ERROR] Failed to update config %s: %v", key, err)
-				return "Failed to update config: " + err.Error()
+				return i18n.T(lang, "config_update_failed", i18n.Args{"error": err})
 			}
 			log.Printf("[INFO] Config updated by admin %d: %s = %s", userID, key, value)
-			return "Config updated: " + key + " = " + value
+			return i18n.T(lang, "config_updated", i18n.Args{"key": key, "value": value})
 		}
 		log.Printf("[WARNING] Invalid /config usage by admin %d", userID)
-		return "Usage: /config KEY VALUE"
+		return i18n.T(lang, "config_usage")
 	}
 	if text == "/config" {
 		rows, err := dbConn.Query("SELECT key, value FROM config")
 		if err != nil {
 			log.Printf("[ERROR] Failed to read config: %v", err)
-			return "Failed to read config: " + err.Error()
+			return i18n.T(lang, "config_read_failed", i18n.Args{"error": err})
 		}
 		defer rows.Close()
 		var out strings.Builder
@@ -312,7 +805,7 @@ func HandleAdminCommand(dbConn *sql.DB, userID int64, text string) string {
 		rows, err := dbConn.Query("SELECT id, user_id, title, created_at FROM posts WHERE status = 'pending'")
 		if err != nil {
 			log.Printf("[ERROR] Failed to query pending posts: %v", err)
-			return "Failed to query pending posts: " + err.Error()
+			return i18n.T(lang, "pending_query_failed", i18n.Args{"error": err})
 		}
 		defer rows.Close()
 		var out strings.Builder
@@ -320,29 +813,29 @@ func HandleAdminCommand(dbConn *sql.DB, userID int64, text string) string {
 			var id, userID int64
 			var title, createdAt string
 			_ = rows.Scan(&id, &userID, &title, &createdAt)
-			out.WriteString(fmt.Sprintf("ID: %d, User: %d, Title: %s, Created: %s\n", id, userID, title, createdAt))
+			out.WriteString(i18n.T(lang, "pending_entry", i18n.Args{"id": id, "user": userID, "title": title, "created": createdAt}) + "\n")
 		}
 		log.Printf("[INFO] Admin %d listed pending posts", userID)
 		return out.String()
 	}
 	log.Printf("[WARNING] Unknown admin command by user %d: %s", userID, text)
-	return "Unknown admin command."
+	return i18n.T(lang, "admin_unknown_command")
 }
 
-func HandleCallbackQuery(db *sql.DB, update tgbotapi.Update, botAPI *tgbotapi.BotAPI, approvedGroupID int64) {
+func HandleCallbackQuery(db *sql.DB, update tgbotapi.Update, botAPI Sender, approvedGroupID int64) {
 	if update.CallbackQuery != nil {
 		data := update.CallbackQuery.Data
-		lang := os.Getenv("LANG")
-		if lang == "" {
-			lang = "en"
-		}
 		userID := update.CallbackQuery.From.ID
-		if data == "approve" {
-			log.Printf("[INFO] Admin %d approved a post via inline button", userID)
-			_ = ApprovePost(db, botAPI, update.CallbackQuery.Message, approvedGroupID)
-		} else if data == "reject" {
-			log.Printf("[INFO] Admin %d rejected a post via inline button", userID)
-			_ = RejectPost(db, botAPI, update.CallbackQuery.Message, "Rejected by admin")
+		action, postID, ok := ParseModerationCallback(data)
+		if !ok {
+			return
+		}
+		if action == "approve" {
+			log.Printf("[INFO] Admin %d approved post %d via inline button", userID, postID)
+			_ = ApprovePost(db, botAPI, postID, approvedGroupID)
+		} else if action == "reject" {
+			log.Printf("[INFO] Admin %d rejected post %d via inline button", userID, postID)
+			_ = RejectPost(db, botAPI, postID, "")
 		}
 		return
 	}
@@ -0,0 +1,140 @@
+// Package bottest provides a recording fake of bot.Sender for tests.
+package bottest
+
+import (
+	"sync"
+
+	"gosalebot/bot"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// Recorder records everything sent through it instead of calling Telegram.
+// Every Send gets a fresh message ID so callers can link to it.
+type Recorder struct {
+	mu       sync.Mutex
+	sent     []tgbotapi.Chattable
+	requests []tgbotapi.Chattable
+	nextID   int
+
+	// SendErr, if set, is returned by every Send call.
+	SendErr error
+}
+
+var _ bot.Sender = (*Recorder)(nil)
+
+func (r *Recorder) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, c)
+	if r.SendErr != nil {
+		return tgbotapi.Message{}, r.SendErr
+	}
+	r.nextID++
+	msg := tgbotapi.Message{MessageID: r.nextID, Chat: &tgbotapi.Chat{ID: chatID(c)}}
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		msg.Text = m.Text
+	}
+	return msg, nil
+}
+
+// SendMediaGroup records the album and returns one message per item.
+func (r *Recorder) SendMediaGroup(config tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, config)
+	if r.SendErr != nil {
+		return nil, r.SendErr
+	}
+	msgs := make([]tgbotapi.Message, 0, len(config.Media))
+	for range config.Media {
+		r.nextID++
+		msgs = append(msgs, tgbotapi.Message{MessageID: r.nextID, Chat: &tgbotapi.Chat{ID: config.ChatID}})
+	}
+	return msgs, nil
+}
+
+func (r *Recorder) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+// Sent returns every Chattable passed to Send, in order.
+func (r *Recorder) Sent() []tgbotapi.Chattable {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]tgbotapi.Chattable(nil), r.sent...)
+}
+
+// Messages returns the text messages passed to Send, in order.
+func (r *Recorder) Messages() []tgbotapi.MessageConfig {
+	var out []tgbotapi.MessageConfig
+	for _, c := range r.Sent() {
+		if m, ok := c.(tgbotapi.MessageConfig); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Photos returns the photos passed to Send, in order.
+func (r *Recorder) Photos() []tgbotapi.PhotoConfig {
+	var out []tgbotapi.PhotoConfig
+	for _, c := range r.Sent() {
+		if p, ok := c.(tgbotapi.PhotoConfig); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// MediaGroups returns the albums passed to SendMediaGroup, in order.
+func (r *Recorder) MediaGroups() []tgbotapi.MediaGroupConfig {
+	var out []tgbotapi.MediaGroupConfig
+	for _, c := range r.Sent() {
+		if g, ok := c.(tgbotapi.MediaGroupConfig); ok {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// Deletes returns the message deletions passed to Request, in order.
+func (r *Recorder) Deletes() []tgbotapi.DeleteMessageConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []tgbotapi.DeleteMessageConfig
+	for _, c := range r.requests {
+		if d, ok := c.(tgbotapi.DeleteMessageConfig); ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Reset forgets everything recorded so far and restarts message IDs at 1.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = nil
+	r.requests = nil
+	r.nextID = 0
+}
+
+func chatID(c tgbotapi.Chattable) int64 {
+	switch v := c.(type) {
+	case tgbotapi.MessageConfig:
+		return v.ChatID
+	case tgbotapi.PhotoConfig:
+		return v.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return v.ChatID
+	case tgbotapi.EditMessageCaptionConfig:
+		return v.ChatID
+	case tgbotapi.DeleteMessageConfig:
+		return v.ChatID
+	}
+	return 0
+}
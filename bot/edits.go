@@ -0,0 +1,317 @@
+package bot
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gosalebot/db"
+	"gosalebot/fsm"
+	"gosalebot/i18n"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// ErrEditStale is returned when an edit request is approved after its
+// listing stopped being published.
+var ErrEditStale = db.ErrEditStale
+
+// ErrEditNotPending is returned when an edit request was already approved,
+// rejected or superseded.
+var ErrEditNotPending = db.ErrEditNotPending
+
+// editPostKey marks a session that edits a published listing rather than
+// drafting a new one. It holds the post ID.
+const editPostKey = "edit_post_id"
+
+// isListingEdit reports whether session edits a published listing.
+func isListingEdit(session *fsm.UserSession) bool {
+	_, ok := session.PostData[editPostKey].(int64)
+	return ok
+}
+
+// startListingEdit loads an approved listing into the seller's session and
+// returns its preview, where the usual edit buttons change single fields.
+func startListingEdit(dbConn *sql.DB, l listing, lang string) (string, *tgbotapi.InlineKeyboardMarkup) {
+	if l.status != "approved" {
+		return listingSummary(lang, l), ListingKeyboard(l.id, l.status, lang)
+	}
+	session, _ := fsm.GetOrCreate(l.userID)
+	if session.State != fsm.StateIdle {
+		// Don't throw away a draft the seller is still writing
+		return i18n.T(lang, "listing_edit_busy"), ListingKeyboard(l.id, l.status, lang)
+	}
+	session.PostData = make(map[string]interface{}, len(l.data)+2)
+	for key, value := range l.data {
+		session.PostData[key] = value
+	}
+	photos, err := db.GetPhotos(dbConn, l.id)
+	if err != nil {
+		log.Printf("[WARNING] startListingEdit: failed to query photos of post %d: %v", l.id, err)
+	}
+	session.PostData["photos"] = photos
+	session.PostData[editPostKey] = l.id
+	session.State = fsm.StatePreview
+	session.Editing = false
+	fsm.Save(session)
+	log.Printf("[INFO] User %d is editing published post %d", l.userID, l.id)
+	return previewText(lang, session), SessionKeyboard(session, lang)
+}
+
+// SessionKeyboard is the StateKeyboard of the state session is in. The
+// photos of a published listing can't be changed, so its preview has no
+// button for them.
+func SessionKeyboard(session *fsm.UserSession, lang string) *tgbotapi.InlineKeyboardMarkup {
+	markup := StateKeyboard(session.State, lang)
+	if markup == nil || session.State != fsm.StatePreview || !isListingEdit(session) {
+		return markup
+	}
+	for i, row := range markup.InlineKeyboard {
+		kept := row[:0]
+		for _, button := range row {
+			if button.CallbackData == nil || *button.CallbackData != "edit:photos" {
+				kept = append(kept, button)
+			}
+		}
+		markup.InlineKeyboard[i] = kept
+	}
+	return markup
+}
+
+// changedFields lists the fields of a listing that differ between old and
+// updated, in wizard order. Prices that render the same are equal.
+func changedFields(old, updated map[string]interface{}) []string {
+	var fields []string
+	for _, step := range wizardSteps {
+		switch step.field {
+		case "photos":
+			continue
+		case "price":
+			if fmt.Sprint(draftPrice("en", old)) != fmt.Sprint(draftPrice("en", updated)) {
+				fields = append(fields, step.field)
+			}
+		default:
+			if fmt.Sprint(old[step.field]) != fmt.Sprint(updated[step.field]) {
+				fields = append(fields, step.field)
+			}
+		}
+	}
+	return fields
+}
+
+// submitListingEdit applies the seller's changes to a published listing.
+// A new price is applied at once; any other change goes to the moderators
+// first, and the listing stays as it is until they approve it.
+func submitListingEdit(dbConn *sql.DB, bot Sender, session *fsm.UserSession, moderationGroupID int64, lang string) string {
+	postID := session.PostData[editPostKey].(int64)
+	l, err := loadListing(dbConn, postID)
+	if err != nil || l.userID != session.UserID || l.status != "approved" {
+		log.Printf("[WARNING] User %d can no longer edit post %d: %v", session.UserID, postID, err)
+		resetSession(session)
+		return i18n.T(lang, "listing_edit_unavailable")
+	}
+	updated := session.PostData
+	fields := changedFields(l.data, updated)
+	if len(fields) == 0 {
+		resetSession(session)
+		return i18n.T(lang, "listing_unchanged")
+	}
+	if !editFits(dbConn, listing{id: l.id, userID: l.userID, status: l.status, data: updated}) {
+		return i18n.T(lang, "listing_edit_too_long")
+	}
+	if len(fields) == 1 && fields[0] == "price" {
+		if err := db.UpdatePostFields(dbConn, postID, updated, fields); err != nil {
+			return i18n.T(lang, "listing_action_failed")
+		}
+		l.data = updated
+		editPublishedListing(dbConn, bot, l, l.status)
+		resetSession(session)
+		log.Printf("[INFO] User %d changed the price of post %d", session.UserID, postID)
+		// The listing changed under any request still waiting for moderation
+		if superseded := supersedeEdits(dbConn, bot, postID, 0); superseded > 0 {
+			return i18n.T(lang, "listing_price_updated") + "\n" + i18n.T(lang, "listing_edits_discarded")
+		}
+		return i18n.T(lang, "listing_price_updated")
+	}
+
+	editID, err := db.SaveListingEdit(dbConn, postID, updated, fields)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save edit of post %d: %v", postID, err)
+		return i18n.T(lang, "listing_action_failed")
+	}
+	msg := tgbotapi.NewMessage(moderationGroupID, editRequestText(DefaultLang(), l, updated, fields))
+	msg.ReplyMarkup = editRequestKeyboard(editID)
+	sent, err := bot.Send(msg)
+	if err != nil {
+		log.Printf("[ERROR] Failed to send edit %d of post %d to moderation: %v", editID, postID, err)
+		// Nobody could decide the request; the changes stay in the preview,
+		// so the seller can confirm them again
+		db.DeleteListingEdit(dbConn, editID)
+		return i18n.T(lang, "listing_edit_send_failed")
+	}
+	if err := db.SetListingEditMessage(dbConn, editID, sent.Chat.ID, sent.MessageID); err != nil {
+		log.Printf("[ERROR] Failed to link edit %d to its moderation message: %v", editID, err)
+	}
+	supersedeEdits(dbConn, bot, postID, editID)
+	resetSession(session)
+	log.Printf("[INFO] User %d submitted edit %d of post %d (%s)", session.UserID, editID, postID, strings.Join(fields, ", "))
+	return i18n.T(lang, "listing_edit_submitted")
+}
+
+// supersedeEdits retires the pending edit requests of a post other than
+// keepID and removes them from the moderation group. It returns how many
+// moderation messages it removed.
+func supersedeEdits(dbConn *sql.DB, bot Sender, postID, keepID int64) int {
+	superseded, err := db.SupersedeListingEdits(dbConn, postID, keepID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to supersede edits of post %d: %v", postID, err)
+		return 0
+	}
+	for _, ref := range superseded {
+		deleteMessage(bot, "supersedeEdits", ref.ChatID, ref.MessageID)
+	}
+	return len(superseded)
+}
+
+// resetSession ends the wizard and drops the draft.
+func resetSession(session *fsm.UserSession) {
+	session.State = fsm.StateIdle
+	session.Editing = false
+	session.PostData = make(map[string]interface{})
+}
+
+// editFits reports whether the new version of l can replace the published
+// one. A listing published as a photo caption must stay within the caption
+// limit.
+func editFits(dbConn *sql.DB, l listing) bool {
+	published, err := db.GetPublishedMessages(dbConn, l.id)
+	if err != nil {
+		return true
+	}
+	for _, m := range published {
+		if m.Kind == db.PublishedCaption {
+			return captionFits(listingText(dbConn, DefaultLang(), l, l.status))
+		}
+	}
+	return true
+}
+
+// editRequestText shows the moderators what a seller wants to change.
+func editRequestText(lang string, l listing, updated map[string]interface{}, fields []string) string {
+	lines := []string{i18n.T(lang, "edit_request", i18n.Args{"id": l.id, "title": l.data["title"]})}
+	for _, field := range fields {
+		before, after := l.data[field], updated[field]
+		if field == "price" {
+			before, after = draftPrice(lang, l.data), draftPrice(lang, updated)
+		}
+		lines = append(lines, i18n.T(lang, "edit_request_change", i18n.Args{"field": field, "old": before, "new": after}))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// editRequestKeyboard builds the Approve/Reject buttons for an edit request.
+func editRequestKeyboard(editID int64) tgbotapi.InlineKeyboardMarkup {
+	lang := DefaultLang()
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_approve"), fmt.Sprintf("approve_edit:%d", editID)),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_reject"), fmt.Sprintf("reject_edit:%d", editID)),
+		),
+	)
+}
+
+// ParseEditCallback splits the data of an edit request button, such as
+// "approve_edit:7", into the action and the edit request ID.
+func ParseEditCallback(data string) (action string, editID int64, ok bool) {
+	return parsePostCallback(data, "approve_edit", "reject_edit")
+}
+
+// ApproveEdit applies the changes of an edit request to its listing, updates
+// the published listing and tells the seller. A listing that was sold,
+// withdrawn or expired in the meantime is left alone and ErrEditStale
+// returned.
+func ApproveEdit(dbConn *sql.DB, bot Sender, editID int64) error {
+	postID, err := db.ApplyListingEdit(dbConn, editID)
+	if errors.Is(err, ErrEditStale) {
+		log.Printf("[INFO] ApproveEdit: post %d of edit %d is no longer published", postID, editID)
+		return err
+	}
+	if err != nil {
+		log.Printf("[ERROR] ApproveEdit: failed to apply edit %d: %v", editID, err)
+		return err
+	}
+	l, err := loadListing(dbConn, postID)
+	if err != nil {
+		log.Printf("[ERROR] ApproveEdit: failed to reload post %d: %v", postID, err)
+		return err
+	}
+	editPublishedListing(dbConn, bot, l, l.status)
+	notifySeller(dbConn, bot, l, "listing_edit_approved")
+	log.Printf("[INFO] Edit %d of post %d approved", editID, postID)
+	return nil
+}
+
+// RejectEdit discards an edit request and tells the seller.
+func RejectEdit(dbConn *sql.DB, bot Sender, editID int64) error {
+	postID, err := db.RejectListingEdit(dbConn, editID)
+	if err != nil {
+		log.Printf("[ERROR] RejectEdit: failed to reject edit %d: %v", editID, err)
+		return err
+	}
+	l, err := loadListing(dbConn, postID)
+	if err != nil {
+		log.Printf("[ERROR] RejectEdit: failed to load post %d: %v", postID, err)
+		return err
+	}
+	notifySeller(dbConn, bot, l, "listing_edit_rejected")
+	log.Printf("[INFO] Edit %d of post %d rejected", editID, postID)
+	return nil
+}
+
+// notifySeller sends the seller of l the message key, in their language.
+func notifySeller(dbConn *sql.DB, bot Sender, l listing, key string) {
+	lang := UserLang(dbConn, l.userID, "")
+	msg := tgbotapi.NewMessage(l.userID, i18n.T(lang, key, i18n.Args{"title": l.data["title"]}))
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("[WARNING] Failed to notify user %d about post %d: %v", l.userID, l.id, err)
+	}
+}
+
+// editPublishedListing rewrites the listing text in the sale group, in the
+// message that holds it or the caption of its first photo. status "sold"
+// shows the listing as sold.
+func editPublishedListing(dbConn *sql.DB, bot Sender, l listing, status string) {
+	rewritePublished(dbConn, bot, l.id, listingMarkdown(dbConn, DefaultLang(), l, status))
+}
+
+// rewritePublished replaces the listing text of post postID in the sale
+// group with text, which is MarkdownV2.
+func rewritePublished(dbConn *sql.DB, bot Sender, postID int64, text string) {
+	published, err := db.GetPublishedMessages(dbConn, postID)
+	if err != nil {
+		return
+	}
+	if len(published) == 0 {
+		log.Printf("[WARNING] rewritePublished: post %d has no recorded published messages", postID)
+		return
+	}
+	for _, m := range published {
+		var edit tgbotapi.Chattable
+		switch m.Kind {
+		case db.PublishedText:
+			e := tgbotapi.NewEditMessageText(m.ChatID, m.MessageID, text)
+			e.ParseMode = "MarkdownV2"
+			edit = e
+		case db.PublishedCaption:
+			e := tgbotapi.NewEditMessageCaption(m.ChatID, m.MessageID, text)
+			e.ParseMode = "MarkdownV2"
+			edit = e
+		default:
+			continue
+		}
+		if _, err := bot.Send(edit); err != nil {
+			log.Printf("[WARNING] rewritePublished: failed to edit message %d: %v", m.MessageID, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"database/sql"
+	"fmt"
+	"gosalebot/db"
+	"gosalebot/i18n"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// Expiry policies, selected with the EXPIRY_POLICY config key.
+const (
+	// ExpiryReject marks the post expired and tells the seller.
+	ExpiryReject = "reject"
+	// ExpiryEscalate reminds the moderation group, pings the admins and
+	// gives the moderators another timeout period.
+	ExpiryEscalate = "escalate"
+	// ExpiryApprove publishes the post as if a moderator had approved it.
+	ExpiryApprove = "approve"
+)
+
+// DefaultExpiryPolicy is used when EXPIRY_POLICY is not set.
+const DefaultExpiryPolicy = ExpiryEscalate
+
+type expiredPost struct {
+	id           int64
+	userID       int64
+	title        string
+	modMessageID sql.NullInt64
+}
+
+// ExpirePosts applies the configured expiry policy to every pending post whose
+// expires_at lies before now, and returns how many posts it handled. now is a
+// parameter so the caller controls the clock.
+func ExpirePosts(dbConn *sql.DB, bot Sender, now time.Time, moderationGroupID, approvedGroupID int64) (int, error) {
+	policy, err := db.GetConfig(dbConn, "EXPIRY_POLICY")
+	if err != nil || policy == "" {
+		policy = DefaultExpiryPolicy
+	}
+	if policy != ExpiryReject && policy != ExpiryEscalate && policy != ExpiryApprove {
+		log.Printf("[WARNING] ExpirePosts: unknown EXPIRY_POLICY %q, using %q", policy, DefaultExpiryPolicy)
+		policy = DefaultExpiryPolicy
+	}
+
+	// Collect the posts first; the policies below run their own queries.
+	rows, err := dbConn.Query(`SELECT id, user_id, title, moderation_message_id FROM posts WHERE status = 'pending' AND expires_at < ?`, db.FormatTime(now))
+	if err != nil {
+		log.Printf("[ERROR] ExpirePosts: failed to query expired posts: %v", err)
+		return 0, err
+	}
+	var expired []expiredPost
+	for rows.Next() {
+		var p expiredPost
+		if err := rows.Scan(&p.id, &p.userID, &p.title, &p.modMessageID); err != nil {
+			log.Printf("[WARNING] ExpirePosts: failed to scan post: %v", err)
+			continue
+		}
+		expired = append(expired, p)
+	}
+	rows.Close()
+
+	handled := 0
+	for _, p := range expired {
+		var err error
+		switch policy {
+		case ExpiryReject:
+			err = rejectExpired(dbConn, bot, p)
+		case ExpiryEscalate:
+			err = escalateExpired(dbConn, bot, p, now, moderationGroupID)
+		case ExpiryApprove:
+			err = ApprovePost(dbConn, bot, p.id, approvedGroupID)
+		}
+		if err != nil {
+			log.Printf("[ERROR] ExpirePosts: policy %q failed for post %d: %v", policy, p.id, err)
+			continue
+		}
+		log.Printf("[INFO] Post %d expired, applied policy %q", p.id, policy)
+		handled++
+	}
+	return handled, nil
+}
+
+func rejectExpired(dbConn *sql.DB, bot Sender, p expiredPost) error {
+	if err := markPost(dbConn, p.id, "expired"); err != nil {
+		return err
+	}
+	msg := tgbotapi.NewMessage(p.userID, i18n.T(UserLang(dbConn, p.userID, ""), "post_expired", i18n.Args{"title": p.title}))
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("[WARNING] ExpirePosts: failed to notify user %d: %v", p.userID, err)
+	}
+	deleteModerationMessages(dbConn, bot, "ExpirePosts", p.id)
+	return nil
+}
+
+func escalateExpired(dbConn *sql.DB, bot Sender, p expiredPost, now time.Time, moderationGroupID int64) error {
+	text := escapeMarkdown(i18n.T(DefaultLang(), "moderation_reminder", i18n.Args{"title": p.title}))
+	if mentions := adminMentions(); mentions != "" {
+		text += "\n" + mentions
+	}
+	msg := tgbotapi.NewMessage(moderationGroupID, text)
+	msg.ParseMode = "MarkdownV2"
+	if p.modMessageID.Valid {
+		msg.ReplyToMessageID = int(p.modMessageID.Int64)
+		msg.AllowSendingWithoutReply = true
+	}
+	sent, err := bot.Send(msg)
+	if err != nil {
+		return err
+	}
+	// The reminder joins the post's moderation bundle, so moderators can reply
+	// to it and it is cleaned up with the rest once the post is decided
+	if err := db.AddModerationMessages(dbConn, p.id, []db.MessageRef{{ChatID: sent.Chat.ID, MessageID: sent.MessageID}}); err != nil {
+		log.Printf("[ERROR] ExpirePosts: failed to record reminder of post %d: %v", p.id, err)
+	}
+	// Give the moderators another period before the next reminder
+	_, err = dbConn.Exec(`UPDATE posts SET expires_at = ? WHERE id = ?`, db.FormatTime(db.ExpiresAt(dbConn, now)), p.id)
+	return err
+}
+
+// adminMentions links every admin in MarkdownV2 so they get notified.
+func adminMentions() string {
+	ids := make([]int64, 0, len(adminIDs))
+	for id := range adminIDs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	// The mentions are read in the moderation group
+	label := escapeMarkdown(i18n.T(DefaultLang(), "mention_admin"))
+	mentions := make([]string, 0, len(ids))
+	for _, id := range ids {
+		mentions = append(mentions, fmt.Sprintf("[%s](tg://user?id=%d)", label, id))
+	}
+	return strings.Join(mentions, " ")
+}
@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"database/sql"
+	"gosalebot/db"
+	"gosalebot/i18n"
+	"log"
+	"os"
+	"strings"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// telegramLocales maps Telegram's IETF language codes to our locale codes
+// where they differ.
+var telegramLocales = map[string]string{
+	"cs": "cz",
+	"iw": "he",
+}
+
+// DefaultLang is the deployment-wide language from LANG, used for the
+// moderation and sale groups and for users without a language of their own.
+func DefaultLang() string {
+	lang := os.Getenv("LANG")
+	if lang == "" {
+		lang = "en"
+	}
+	return lang
+}
+
+// localeFromTelegram converts a Telegram language code such as "cs" or
+// "en-US" to a supported locale, or "" if there is none.
+func localeFromTelegram(code string) string {
+	code = strings.ToLower(code)
+	code, _, _ = strings.Cut(code, "-")
+	if mapped, ok := telegramLocales[code]; ok {
+		code = mapped
+	}
+	if i18n.Supported(code) {
+		return code
+	}
+	return ""
+}
+
+// UserLang returns the language to talk to userID in. A language stored with
+// /language wins; otherwise telegramCode (the user's Telegram client
+// language, if known) is stored as the initial choice; otherwise LANG applies.
+func UserLang(dbConn *sql.DB, userID int64, telegramCode string) string {
+	lang, err := db.GetUserLang(dbConn, userID)
+	if err != nil {
+		log.Printf("[WARNING] Failed to read language of user %d: %v", userID, err)
+	}
+	if i18n.Supported(lang) {
+		return lang
+	}
+	if detected := localeFromTelegram(telegramCode); detected != "" {
+		if err := db.SetUserLang(dbConn, userID, detected); err == nil {
+			log.Printf("[INFO] Detected language %s for user %d", detected, userID)
+		}
+		return detected
+	}
+	return DefaultLang()
+}
+
+// LanguageKeyboard offers every available locale, labelled in its own language.
+func LanguageKeyboard() tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	for _, lang := range i18n.Locales() {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "language_name"), "lang:"+lang))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// HandleLanguageCallback stores the language picked from LanguageKeyboard and
+// returns the confirmation, in the new language. handled is false if data is
+// not a language choice.
+func HandleLanguageCallback(dbConn *sql.DB, userID int64, data string) (resp string, handled bool) {
+	lang, ok := strings.CutPrefix(data, "lang:")
+	if !ok {
+		return "", false
+	}
+	if !i18n.Supported(lang) {
+		log.Printf("[WARNING] User %d picked unknown language %q", userID, lang)
+		return "", true
+	}
+	if err := db.SetUserLang(dbConn, userID, lang); err != nil {
+		return "", true
+	}
+	log.Printf("[INFO] User %d set language to %s", userID, lang)
+	return i18n.T(lang, "language_set"), true
+}
@@ -0,0 +1,161 @@
+package bot
+
+import (
+	"database/sql"
+	"fmt"
+	"gosalebot/db"
+	"gosalebot/i18n"
+	"log"
+	"math"
+	"time"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// Listing expiry actions, selected with the LISTING_EXPIRY_ACTION config key.
+const (
+	// ListingExpiryDelete deletes an expired listing from the sale group.
+	ListingExpiryDelete = "delete"
+	// ListingExpiryStrike leaves an expired listing in the sale group, struck
+	// through.
+	ListingExpiryStrike = "strike"
+)
+
+// DefaultListingExpiryAction is used when LISTING_EXPIRY_ACTION is not set.
+const DefaultListingExpiryAction = ListingExpiryDelete
+
+type publishedPost struct {
+	id        int64
+	status    string
+	expiresAt time.Time
+}
+
+// ExpireListings reminds the sellers of approved listings that expire within
+// LISTING_REMINDER_DAYS, and takes down approved and sold listings whose
+// lifetime ended before now. An approved listing becomes expired and can be
+// renewed; a sold one stays sold. It returns how many listings it took down.
+func ExpireListings(dbConn *sql.DB, bot Sender, now time.Time) (int, error) {
+	action, err := db.GetConfig(dbConn, "LISTING_EXPIRY_ACTION")
+	if err != nil || action == "" {
+		action = DefaultListingExpiryAction
+	}
+	if action != ListingExpiryDelete && action != ListingExpiryStrike {
+		log.Printf("[WARNING] ExpireListings: unknown LISTING_EXPIRY_ACTION %q, using %q", action, DefaultListingExpiryAction)
+		action = DefaultListingExpiryAction
+	}
+
+	reminders, err := queryPublished(dbConn, `SELECT id, status, listing_expires_at FROM posts WHERE status = 'approved' AND reminded_at IS NULL AND listing_expires_at >= ? AND listing_expires_at < ?`,
+		db.FormatTime(now), db.FormatTime(now.Add(db.ListingReminder(dbConn))))
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range reminders {
+		remindSeller(dbConn, bot, p, now)
+	}
+
+	expired, err := queryPublished(dbConn, `SELECT id, status, listing_expires_at FROM posts WHERE status IN ('approved', 'sold') AND listing_expires_at < ?`, db.FormatTime(now))
+	if err != nil {
+		return 0, err
+	}
+	handled := 0
+	for _, p := range expired {
+		if err := expireListing(dbConn, bot, p, action); err != nil {
+			log.Printf("[ERROR] ExpireListings: failed to take down post %d: %v", p.id, err)
+			continue
+		}
+		log.Printf("[INFO] Listing %d (%s) reached the end of its lifetime, applied %q", p.id, p.status, action)
+		handled++
+	}
+	return handled, nil
+}
+
+// queryPublished collects the posts a lifetime query returns; the caller
+// runs its own queries for each of them.
+func queryPublished(dbConn *sql.DB, query string, args ...interface{}) ([]publishedPost, error) {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		log.Printf("[ERROR] ExpireListings: failed to query listings: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []publishedPost
+	for rows.Next() {
+		var p publishedPost
+		if err := rows.Scan(&p.id, &p.status, &p.expiresAt); err != nil {
+			log.Printf("[WARNING] ExpireListings: failed to scan post: %v", err)
+			continue
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+// remindSeller tells the seller of p how many days its listing has left and
+// offers to renew it or mark it sold. A seller is reminded once per
+// lifetime, even if the message can't be delivered.
+func remindSeller(dbConn *sql.DB, bot Sender, p publishedPost, now time.Time) {
+	if _, err := dbConn.Exec(`UPDATE posts SET reminded_at = ? WHERE id = ?`, db.FormatTime(now), p.id); err != nil {
+		log.Printf("[ERROR] ExpireListings: failed to mark post %d reminded: %v", p.id, err)
+		return
+	}
+	l, err := loadListing(dbConn, p.id)
+	if err != nil {
+		log.Printf("[ERROR] ExpireListings: failed to load post %d: %v", p.id, err)
+		return
+	}
+	days := max(1, int(math.Ceil(p.expiresAt.Sub(now).Hours()/24)))
+	lang := UserLang(dbConn, l.userID, "")
+	msg := tgbotapi.NewMessage(l.userID, i18n.T(lang, "listing_expiry_reminder", i18n.Args{"title": l.data["title"], "days": days}))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_renew"), fmt.Sprintf("renew:%d", l.id)),
+		tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_sold"), fmt.Sprintf("sold:%d", l.id)),
+	))
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("[WARNING] ExpireListings: failed to remind user %d about post %d: %v", l.userID, l.id, err)
+		return
+	}
+	log.Printf("[INFO] Reminded user %d that post %d expires in %d days", l.userID, l.id, days)
+}
+
+// expireListing takes down the published messages of p with action. An
+// approved listing becomes expired and its seller is told; a sold one keeps
+// its status and only loses its lifetime, so it is handled once.
+func expireListing(dbConn *sql.DB, bot Sender, p publishedPost, action string) error {
+	l, err := loadListing(dbConn, p.id)
+	if err != nil {
+		return err
+	}
+	if p.status == "approved" {
+		if err := moveListing(dbConn, p.id, "approved", "expired"); err != nil {
+			return err
+		}
+	} else if _, err := dbConn.Exec(`UPDATE posts SET listing_expires_at = NULL WHERE id = ?`, p.id); err != nil {
+		return err
+	}
+
+	if action == ListingExpiryStrike {
+		// The old messages stay recorded, so a renewal can delete them
+		rewritePublished(dbConn, bot, l.id, "~"+listingMarkdown(dbConn, DefaultLang(), l, p.status)+"~")
+	} else {
+		published, err := db.GetPublishedMessages(dbConn, l.id)
+		if err != nil {
+			return err
+		}
+		deletePublished(bot, "ExpireListings", published)
+		if err := db.DeletePublishedMessages(dbConn, l.id); err != nil {
+			return err
+		}
+	}
+
+	if p.status == "approved" {
+		lang := UserLang(dbConn, l.userID, "")
+		msg := tgbotapi.NewMessage(l.userID, i18n.T(lang, "listing_expired", i18n.Args{"title": l.data["title"]}))
+		if markup := ListingKeyboard(l.id, "expired", lang); markup != nil {
+			msg.ReplyMarkup = *markup
+		}
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("[WARNING] ExpireListings: failed to notify user %d about post %d: %v", l.userID, l.id, err)
+		}
+	}
+	return nil
+}
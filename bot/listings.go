@@ -0,0 +1,330 @@
+package bot
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gosalebot/db"
+	"gosalebot/i18n"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// maxListingsShown is how many of a seller's listings /mylistings shows,
+// newest first.
+const maxListingsShown = 10
+
+// listing is a post as stored. data holds its fields under the keys a
+// draft's PostData uses, so the same helpers render both.
+type listing struct {
+	id     int64
+	userID int64
+	status string
+	data   map[string]interface{}
+}
+
+func loadListing(dbConn *sql.DB, postID int64) (listing, error) {
+	l := listing{id: postID}
+	var title, description, price, location string
+	var priceAmount sql.NullInt64
+	var priceCurrency, priceKind sql.NullString
+	err := dbConn.QueryRow("SELECT user_id, status, title, description, price, price_amount, price_currency, price_kind, location FROM posts WHERE id = ?", postID).
+		Scan(&l.userID, &l.status, &title, &description, &price, &priceAmount, &priceCurrency, &priceKind, &location)
+	if err != nil {
+		return l, err
+	}
+	l.data = storedPrice(price, priceAmount, priceCurrency, priceKind)
+	l.data["title"] = title
+	l.data["description"] = description
+	l.data["location"] = location
+	return l, nil
+}
+
+// listingText renders a listing for the sale group as plain text, as long
+// as it reads once sent: a seller without a usable username shows as the
+// label of their mention. status "sold" marks it as sold.
+func listingText(dbConn *sql.DB, lang string, l listing, status string) string {
+	postedBy := i18n.T(lang, "mention_user")
+	if username := sellerUsername(dbConn, l.userID); username != "" {
+		postedBy = "@" + username
+	}
+	return renderListing(lang, l, status, postedBy)
+}
+
+// mentionMarker stands in for the seller's mention until the listing text is
+// escaped. Telegram drops NUL from messages, so no field can hold it.
+const mentionMarker = "\x00"
+
+// listingMarkdown renders a listing for the sale group as MarkdownV2. A
+// seller without a usable username is linked by ID; the link goes in after
+// the text is escaped, so it stays a link.
+func listingMarkdown(dbConn *sql.DB, lang string, l listing, status string) string {
+	if username := sellerUsername(dbConn, l.userID); username != "" {
+		return escapeMarkdown(renderListing(lang, l, status, "@"+username))
+	}
+	text := escapeMarkdown(renderListing(lang, l, status, mentionMarker))
+	link := fmt.Sprintf("[%s](tg://user?id=%d)", escapeMarkdown(i18n.T(lang, "mention_user")), l.userID)
+	return strings.Replace(text, mentionMarker, link, 1)
+}
+
+// sellerUsername returns the username of a seller if it is safe to mention,
+// or "".
+func sellerUsername(dbConn *sql.DB, userID int64) string {
+	var username string
+	err := dbConn.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err != nil {
+		log.Printf("[WARNING] listingText: failed to find username for userID '%d': %v", userID, err)
+	}
+	// Only allow safe Telegram usernames (alphanumeric and underscores)
+	if username != "" && isSafeUsername(username) {
+		return username
+	}
+	return ""
+}
+
+// renderListing fills the listing template, with postedBy for the seller.
+func renderListing(lang string, l listing, status, postedBy string) string {
+	return i18n.T(lang, "for_sale", i18n.Args{
+		"status":      status,
+		"title":       l.data["title"],
+		"description": l.data["description"],
+		"price":       draftPrice(lang, l.data),
+		"location":    l.data["location"],
+		"posted_by":   postedBy,
+	})
+}
+
+// listingSummary is the line /mylistings shows for a listing.
+func listingSummary(lang string, l listing) string {
+	return i18n.T(lang, "my_listing", i18n.Args{
+		"id":     l.id,
+		"title":  l.data["title"],
+		"price":  draftPrice(lang, l.data),
+		"status": l.status,
+	})
+}
+
+// ListingKeyboard offers the actions a seller can take on a listing in
+// status, or returns nil if there are none.
+func ListingKeyboard(postID int64, status, lang string) *tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	switch status {
+	case "approved":
+		row = append(row,
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_edit_listing"), fmt.Sprintf("edit_listing:%d", postID)),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_sold"), fmt.Sprintf("sold:%d", postID)),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_withdraw"), fmt.Sprintf("withdraw:%d", postID)),
+		)
+	case "pending":
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_withdraw"), fmt.Sprintf("withdraw:%d", postID)))
+	case "expired":
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "button_renew"), fmt.Sprintf("renew:%d", postID)))
+	default:
+		return nil
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(row)
+	return &markup
+}
+
+// SendMyListings answers /mylistings with one message per listing of
+// userID, each with the actions its status allows. Withdrawn listings are
+// left out.
+func SendMyListings(dbConn *sql.DB, bot Sender, userID, chatID int64, lang string) {
+	rows, err := dbConn.Query("SELECT id FROM posts WHERE user_id = ? AND status != 'withdrawn' ORDER BY id DESC LIMIT ?", userID, maxListingsShown)
+	if err != nil {
+		log.Printf("[ERROR] SendMyListings: failed to query posts of user %d: %v", userID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, i18n.T(lang, "my_listings_failed")))
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("[WARNING] SendMyListings: failed to scan post: %v", err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, i18n.T(lang, "my_listings_empty")))
+		return
+	}
+	for _, id := range ids {
+		l, err := loadListing(dbConn, id)
+		if err != nil {
+			log.Printf("[WARNING] SendMyListings: failed to load post %d: %v", id, err)
+			continue
+		}
+		msg := tgbotapi.NewMessage(chatID, listingSummary(lang, l))
+		if markup := ListingKeyboard(l.id, l.status, lang); markup != nil {
+			msg.ReplyMarkup = *markup
+		}
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("[ERROR] SendMyListings: failed to send post %d: %v", id, err)
+		}
+	}
+	log.Printf("[INFO] User %d listed %d of their listings", userID, len(ids))
+}
+
+// ParseListingCallback splits the data of a /mylistings button, such as
+// "sold:42", into the action and the post ID.
+func ParseListingCallback(data string) (action string, postID int64, ok bool) {
+	return parsePostCallback(data, "edit_listing", "sold", "renew", "withdraw")
+}
+
+// errListingUnavailable is returned when a seller action doesn't apply to
+// the listing's current status, e.g. because it was sold in the meantime.
+var errListingUnavailable = errors.New("listing is not in a status the action applies to")
+
+// HandleListingAction runs a /mylistings button pressed by userID and returns
+// the new text and keyboard of the listing's message.
+func HandleListingAction(dbConn *sql.DB, bot Sender, userID int64, action string, postID, moderationGroupID, approvedGroupID int64, lang string) (string, *tgbotapi.InlineKeyboardMarkup) {
+	l, err := loadListing(dbConn, postID)
+	if err != nil || l.userID != userID {
+		// Someone else's post is treated like a missing one
+		log.Printf("[WARNING] User %d tried to %s post %d they don't own: %v", userID, action, postID, err)
+		return i18n.T(lang, "listing_not_found"), nil
+	}
+	switch action {
+	case "edit_listing":
+		return startListingEdit(dbConn, l, lang)
+	case "sold":
+		err = markSold(dbConn, bot, l)
+	case "withdraw":
+		err = withdrawListing(dbConn, bot, l)
+	case "renew":
+		err = renewListing(dbConn, bot, l, moderationGroupID, approvedGroupID)
+	}
+	if errors.Is(err, errListingUnavailable) {
+		log.Printf("[INFO] User %d can't %s post %d in status %s", userID, action, postID, l.status)
+	} else if err != nil {
+		log.Printf("[ERROR] Failed to %s post %d: %v", action, postID, err)
+		return i18n.T(lang, "listing_action_failed"), ListingKeyboard(l.id, l.status, lang)
+	} else {
+		log.Printf("[INFO] User %d chose %s for post %d", userID, action, postID)
+	}
+	if l, err = loadListing(dbConn, postID); err != nil {
+		log.Printf("[ERROR] Failed to reload post %d: %v", postID, err)
+		return i18n.T(lang, "listing_action_failed"), nil
+	}
+	return listingSummary(lang, l), ListingKeyboard(l.id, l.status, lang)
+}
+
+// moveListing changes the status of a listing from from to to. The status
+// check is part of the UPDATE, like in markPost.
+func moveListing(dbConn *sql.DB, postID int64, from, to string) error {
+	res, err := dbConn.Exec("UPDATE posts SET status = ? WHERE id = ? AND status = ?", to, postID, from)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errListingUnavailable
+	}
+	return nil
+}
+
+// markSold marks an approved listing sold and shows it as sold in the sale
+// group.
+func markSold(dbConn *sql.DB, bot Sender, l listing) error {
+	if err := moveListing(dbConn, l.id, "approved", "sold"); err != nil {
+		return err
+	}
+	editPublishedListing(dbConn, bot, l, "sold")
+	return nil
+}
+
+// withdrawListing takes a listing down: an approved one is deleted from the
+// sale group, a pending one from the moderation group.
+func withdrawListing(dbConn *sql.DB, bot Sender, l listing) error {
+	// The status may have changed since l was loaded, so try both
+	err := moveListing(dbConn, l.id, "pending", "withdrawn")
+	if err == nil {
+		deleteModerationMessages(dbConn, bot, "withdrawListing", l.id)
+		return nil
+	}
+	if !errors.Is(err, errListingUnavailable) {
+		return err
+	}
+	if err := moveListing(dbConn, l.id, "approved", "withdrawn"); err != nil {
+		return err
+	}
+	published, err := db.GetPublishedMessages(dbConn, l.id)
+	if err != nil {
+		return err
+	}
+	deletePublished(bot, "withdrawListing", published)
+	return db.DeletePublishedMessages(dbConn, l.id)
+}
+
+// renewListing keeps a listing up: an approved one gets a new lifetime, one
+// that expired after it was published is published again at once, and one
+// that expired in moderation goes back to moderation with a new timeout.
+func renewListing(dbConn *sql.DB, bot Sender, l listing, moderationGroupID, approvedGroupID int64) error {
+	if l.status == "approved" {
+		err := db.ExtendListing(dbConn, l.id, time.Now())
+		if errors.Is(err, db.ErrPostNotApproved) {
+			return errListingUnavailable
+		}
+		return err
+	}
+	var wasPublished bool
+	if err := dbConn.QueryRow("SELECT published_at IS NOT NULL FROM posts WHERE id = ?", l.id).Scan(&wasPublished); err != nil {
+		return err
+	}
+	if wasPublished {
+		return republishListing(dbConn, bot, l, approvedGroupID)
+	}
+	expiresAt := db.FormatTime(db.ExpiresAt(dbConn, time.Now()))
+	res, err := dbConn.Exec("UPDATE posts SET status = 'pending', expires_at = ? WHERE id = ? AND status = 'expired'", expiresAt, l.id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errListingUnavailable
+	}
+	// The messages of the first round were deleted when it expired
+	if err := db.DeleteModerationMessages(dbConn, l.id); err != nil {
+		return err
+	}
+	photos, err := db.GetPhotos(dbConn, l.id)
+	if err != nil {
+		log.Printf("[WARNING] renewListing: failed to query photos: %v", err)
+	}
+	if err := sendForModeration(dbConn, bot, l.id, moderationGroupID, moderationText(dbConn, l.id, l.data), photos); err != nil {
+		// Without a moderation message nobody could decide it; let the
+		// seller renew it again
+		if _, resetErr := dbConn.Exec("UPDATE posts SET status = 'expired' WHERE id = ? AND status = 'pending'", l.id); resetErr != nil {
+			log.Printf("[ERROR] renewListing: failed to put post %d back to expired: %v", l.id, resetErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// republishListing publishes a listing that expired after its approval
+// again, and removes what is left of its previous publication.
+func republishListing(dbConn *sql.DB, bot Sender, l listing, approvedGroupID int64) error {
+	published, err := sendListing(dbConn, bot, l, approvedGroupID)
+	if err != nil {
+		deletePublished(bot, "republishListing", published)
+		return err
+	}
+	old, err := db.RepublishPost(dbConn, l.id, published, time.Now())
+	if err != nil {
+		deletePublished(bot, "republishListing", published)
+		if errors.Is(err, db.ErrPostNotExpired) {
+			return errListingUnavailable
+		}
+		return err
+	}
+	deletePublished(bot, "republishListing", old)
+	return nil
+}
@@ -0,0 +1,194 @@
+package bot
+
+import (
+	"database/sql"
+	"gosalebot/db"
+	"gosalebot/i18n"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Price kinds, stored in posts.price_kind.
+const (
+	PriceFixed      = "fixed"
+	PriceFree       = "free"
+	PriceNegotiable = "negotiable"
+)
+
+// DefaultCurrency is used for prices without a currency when the
+// DEFAULT_CURRENCY config key is not set.
+const DefaultCurrency = "EUR"
+
+// Price is a parsed price. Amount is in hundredths of the currency unit, so
+// prices sort and compare exactly; it is only set for PriceFixed.
+type Price struct {
+	Kind     string
+	Amount   int64
+	Currency string
+}
+
+// currencyAliases maps what sellers type to ISO 4217 codes. Keys are lower case.
+var currencyAliases = map[string]string{
+	"czk": "CZK", "kč": "CZK", "kc": "CZK", "korun": "CZK",
+	"eur": "EUR", "€": "EUR", "euro": "EUR", "euros": "EUR",
+	"usd": "USD", "$": "USD",
+	"gbp": "GBP", "£": "GBP",
+	"ils": "ILS", "₪": "ILS", "nis": "ILS", "ש\"ח": "ILS", "שח": "ILS",
+	"pln": "PLN", "zł": "PLN", "zl": "PLN",
+	"chf": "CHF",
+}
+
+// currencySymbols are shown instead of the ISO code where one is common.
+var currencySymbols = map[string]string{
+	"CZK": "Kč",
+	"EUR": "€",
+	"USD": "$",
+	"GBP": "£",
+	"ILS": "₪",
+	"PLN": "zł",
+}
+
+// priceKeywords are the words, in every supported language, for prices
+// that aren't an amount.
+var priceKeywords = map[string]string{
+	"free": PriceFree, "zdarma": PriceFree, "zadarmo": PriceFree, "חינם": PriceFree,
+	"negotiable": PriceNegotiable, "neg": PriceNegotiable, "obo": PriceNegotiable,
+	"dohodou": PriceNegotiable, "dohoda": PriceNegotiable, "k jednání": PriceNegotiable,
+	"לפי הצעה": PriceNegotiable, "גמיש": PriceNegotiable,
+}
+
+// pricePattern splits "€ 1 500,50", "42 eur" or "$42" into an optional
+// leading currency, the number and an optional trailing currency.
+var pricePattern = regexp.MustCompile(`^([^\d\s.,]*)\s*(\d[\d\s.,'\x{00a0}]*?)(?:[.,]-)?\s*([^\d\s.,]*)$`)
+
+// ParsePrice reads a price as a seller types it. An amount without a
+// currency gets defaultCurrency. ok is false if text isn't a price.
+func ParsePrice(text, defaultCurrency string) (price Price, ok bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if kind, ok := priceKeywords[text]; ok {
+		return Price{Kind: kind}, true
+	}
+	m := pricePattern.FindStringSubmatch(text)
+	if m == nil || (m[1] != "" && m[3] != "") {
+		return Price{}, false
+	}
+	currency := defaultCurrency
+	if symbol := m[1] + m[3]; symbol != "" {
+		if currency, ok = currencyAliases[symbol]; !ok {
+			return Price{}, false
+		}
+	}
+	amount, ok := parseAmount(m[2])
+	if !ok {
+		return Price{}, false
+	}
+	return Price{Kind: PriceFixed, Amount: amount, Currency: currency}, true
+}
+
+// parseAmount turns "1 500", "1,500.50" or "1.500,5" into hundredths. A
+// separator followed by exactly three digits groups thousands; otherwise the
+// last separator is the decimal point.
+func parseAmount(s string) (int64, bool) {
+	s = strings.NewReplacer(" ", "", "\u00a0", "", "'", "").Replace(s)
+	whole, frac := s, ""
+	if i := strings.LastIndexAny(s, ".,"); i >= 0 && len(s)-i-1 != 3 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	whole = strings.NewReplacer(".", "", ",", "").Replace(whole)
+	if whole == "" || len(frac) > 2 {
+		return 0, false
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > 1e12 {
+		return 0, false
+	}
+	cents := int64(0)
+	if frac != "" {
+		n, err := strconv.Atoi(frac)
+		if err != nil {
+			return 0, false
+		}
+		if len(frac) == 1 {
+			n *= 10
+		}
+		cents = int64(n)
+	}
+	return units*100 + cents, true
+}
+
+// Decimal and thousands separators per locale; others use English ones.
+var numberSeparators = map[string][2]string{
+	"en": {".", ","},
+	"cz": {",", "\u00a0"},
+	"he": {".", ","},
+}
+
+// formatAmount writes hundredths as a number in lang, without decimals
+// when they are zero.
+func formatAmount(lang string, amount int64) string {
+	seps, ok := numberSeparators[lang]
+	if !ok {
+		seps = numberSeparators["en"]
+	}
+	digits := strconv.FormatInt(amount/100, 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(seps[1])
+		}
+		b.WriteRune(d)
+	}
+	if cents := amount % 100; cents != 0 {
+		b.WriteString(seps[0] + strconv.FormatInt(100+cents, 10)[1:])
+	}
+	return b.String()
+}
+
+// FormatPrice renders price for a reader of lang.
+func FormatPrice(lang string, price Price) string {
+	switch price.Kind {
+	case PriceFree:
+		return i18n.T(lang, "price_free")
+	case PriceNegotiable:
+		return i18n.T(lang, "price_negotiable")
+	}
+	currency := price.Currency
+	if symbol, ok := currencySymbols[currency]; ok {
+		currency = symbol
+	}
+	return i18n.T(lang, "price_fixed", i18n.Args{"amount": formatAmount(lang, price.Amount), "currency": currency})
+}
+
+// defaultCurrency is the deployment's currency for prices typed without one.
+func defaultCurrency(dbConn *sql.DB) string {
+	currency, err := db.GetConfig(dbConn, "DEFAULT_CURRENCY")
+	if err != nil || currency == "" {
+		return DefaultCurrency
+	}
+	return strings.ToUpper(currency)
+}
+
+// draftPrice renders the price of a draft or post. Posts from before prices
+// were parsed only have the text the seller typed.
+func draftPrice(lang string, postData map[string]interface{}) interface{} {
+	kind, _ := postData["price_kind"].(string)
+	if kind == "" {
+		return postData["price"]
+	}
+	amount, _ := postData["price_amount"].(int64)
+	currency, _ := postData["price_currency"].(string)
+	return FormatPrice(lang, Price{Kind: kind, Amount: amount, Currency: currency})
+}
+
+// storedPrice puts the price columns of a post into the shape draftPrice
+// reads. The structured columns are NULL for posts from before migration 0008.
+func storedPrice(text string, amount sql.NullInt64, currency, kind sql.NullString) map[string]interface{} {
+	postData := map[string]interface{}{"price": text}
+	if kind.Valid {
+		postData["price_kind"] = kind.String
+		postData["price_amount"] = amount.Int64
+		postData["price_currency"] = currency.String
+	}
+	return postData
+}
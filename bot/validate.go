@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"database/sql"
+	"gosalebot/db"
+	"gosalebot/fsm"
+	"gosalebot/i18n"
+	"strings"
+	"unicode/utf8"
+)
+
+// fieldValidator checks a value typed for one field of the wizard. It
+// returns the value to store, or a localized message saying what is wrong
+// with it; the wizard then stays at the same step.
+type fieldValidator func(dbConn *sql.DB, field, value, lang string) (string, string)
+
+// fieldValidators lists the checks for each text field, in the order they
+// run. Every field must be text within its configured length first.
+var fieldValidators = map[string][]fieldValidator{
+	"title":       {validateLength, validateSingleLine},
+	"description": {validateLength},
+	"price":       {validateLength, validateSingleLine},
+	"location":    {validateLength, validateSingleLine},
+}
+
+// validateField runs the validators of field on what the user sent. text is
+// empty for anything that isn't a text message, such as stickers or voice
+// messages; photos are refused too, since a photo's caption is not the field.
+func validateField(dbConn *sql.DB, field, text string, newPhotos []fsm.Photo, lang string) (value, problem string) {
+	if len(newPhotos) > 0 || strings.TrimSpace(text) == "" {
+		return "", i18n.T(lang, "field_text_required", i18n.Args{"field": field})
+	}
+	value = strings.TrimSpace(text)
+	for _, validate := range fieldValidators[field] {
+		if value, problem = validate(dbConn, field, value, lang); problem != "" {
+			return "", problem
+		}
+	}
+	return value, ""
+}
+
+// validateLength enforces the field's <FIELD>_MIN_LENGTH and
+// <FIELD>_MAX_LENGTH config keys, counted in characters.
+func validateLength(dbConn *sql.DB, field, value, lang string) (string, string) {
+	limit := db.FieldLength(dbConn, field)
+	length := utf8.RuneCountInString(value)
+	if length < limit.Min {
+		return "", i18n.T(lang, "field_too_short", i18n.Args{"field": field, "min": limit.Min})
+	}
+	if length > limit.Max {
+		return "", i18n.T(lang, "field_too_long", i18n.Args{"field": field, "max": limit.Max, "length": length})
+	}
+	return value, ""
+}
+
+// validateSingleLine refuses line breaks in fields shown on one line of
+// the listing.
+func validateSingleLine(_ *sql.DB, field, value, lang string) (string, string) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", i18n.T(lang, "field_single_line", i18n.Args{"field": field})
+	}
+	return value, ""
+}
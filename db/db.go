@@ -2,26 +2,87 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gosalebot/fsm"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func SavePhotoToDB(db *sql.DB, postID int64, fileID string) error {
-	stmt, err := db.Prepare(`INSERT INTO photos (post_id, file_id) VALUES (?, ?)`)
+func SavePhotoToDB(db *sql.DB, postID int64, photo fsm.Photo) error {
+	stmt, err := db.Prepare(`INSERT INTO photos (post_id, file_id, file_unique_id, width, height, file_size, is_document) VALUES (?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Printf("[ERROR] Prepare SavePhotoToDB: %v", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(postID, fileID)
+	_, err = stmt.Exec(postID, photo.FileID, nullString(photo.FileUniqueID), photo.Width, photo.Height, photo.FileSize, photo.Document)
 	if err != nil {
 		log.Printf("[ERROR] Exec SavePhotoToDB: %v", err)
 	}
 	return err
 }
 
+// nullString stores "" as NULL, so unknown unique IDs never match each other.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// GetPhotos returns a post's photos in the order they were sent.
+func GetPhotos(db *sql.DB, postID int64) ([]fsm.Photo, error) {
+	rows, err := db.Query(`SELECT file_id, file_unique_id, width, height, file_size, is_document FROM photos WHERE post_id = ? ORDER BY id`, postID)
+	if err != nil {
+		log.Printf("[ERROR] Query GetPhotos: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var photos []fsm.Photo
+	for rows.Next() {
+		var photo fsm.Photo
+		var uniqueID sql.NullString
+		var width, height, size sql.NullInt64
+		if err := rows.Scan(&photo.FileID, &uniqueID, &width, &height, &size, &photo.Document); err != nil {
+			log.Printf("[ERROR] Scan GetPhotos: %v", err)
+			return nil, err
+		}
+		photo.FileUniqueID = uniqueID.String
+		photo.Width, photo.Height, photo.FileSize = int(width.Int64), int(height.Int64), size.Int64
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+// DuplicatePhotoPosts returns the other pending or approved posts that use a
+// photo of postID, matched by Telegram's file_unique_id.
+func DuplicatePhotoPosts(db *sql.DB, postID int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT DISTINCT other.post_id FROM photos mine
+		JOIN photos other ON other.file_unique_id = mine.file_unique_id AND other.post_id != mine.post_id
+		JOIN posts p ON p.id = other.post_id
+		WHERE mine.post_id = ? AND p.status IN ('pending', 'approved')
+		ORDER BY other.post_id`, postID)
+	if err != nil {
+		log.Printf("[ERROR] Query DuplicatePhotoPosts: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var postIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("[ERROR] Scan DuplicatePhotoPosts: %v", err)
+			return nil, err
+		}
+		postIDs = append(postIDs, id)
+	}
+	return postIDs, rows.Err()
+}
+
 func SavePostToDB(db *sql.DB, userID int64, postData map[string]interface{}) (int64, error) {
-	stmt, err := db.Prepare(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now', '+24 hours'))`)
+	stmt, err := db.Prepare(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, price_amount, price_currency, price_kind, location, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Printf("[ERROR] Prepare SavePostToDB: %v", err)
 		return 0, err
@@ -29,6 +90,7 @@ func SavePostToDB(db *sql.DB, userID int64, postData map[string]interface{}) (in
 	defer stmt.Close()
 	chatID, _ := postData["chat_id"].(int64)
 	messageID, _ := postData["message_id"].(int)
+	now := time.Now()
 	res, err := stmt.Exec(
 		userID,
 		chatID,
@@ -37,7 +99,12 @@ func SavePostToDB(db *sql.DB, userID int64, postData map[string]interface{}) (in
 		postData["title"],
 		postData["description"],
 		postData["price"],
+		postData["price_amount"],
+		postData["price_currency"],
+		postData["price_kind"],
 		postData["location"],
+		FormatTime(now),
+		FormatTime(ExpiresAt(db, now)),
 	)
 	if err != nil {
 		log.Printf("[ERROR] Exec SavePostToDB: %v", err)
@@ -48,9 +115,9 @@ func SavePostToDB(db *sql.DB, userID int64, postData map[string]interface{}) (in
 		log.Printf("[ERROR] LastInsertId SavePostToDB: %v", err)
 		return 0, err
 	}
-	if photos, ok := postData["photos"].([]string); ok {
-		for _, fileID := range photos {
-			if err := SavePhotoToDB(db, postID, fileID); err != nil {
+	if photos, ok := postData["photos"].([]fsm.Photo); ok {
+		for _, photo := range photos {
+			if err := SavePhotoToDB(db, postID, photo); err != nil {
 				log.Printf("[ERROR] SavePhotoToDB in SavePostToDB: %v", err)
 			}
 		}
@@ -58,6 +125,242 @@ func SavePostToDB(db *sql.DB, userID int64, postData map[string]interface{}) (in
 	return postID, nil
 }
 
+// SetModerationMessage links a post to the message that was sent to the
+// moderation group, so approve/reject can find it without parsing the text.
+func SetModerationMessage(db *sql.DB, postID, chatID int64, messageID int) error {
+	_, err := db.Exec(`UPDATE posts SET moderation_chat_id = ?, moderation_message_id = ? WHERE id = ?`, chatID, messageID, postID)
+	if err != nil {
+		log.Printf("[ERROR] Exec SetModerationMessage: %v", err)
+	}
+	return err
+}
+
+// MessageRef identifies a Telegram message.
+type MessageRef struct {
+	ChatID    int64
+	MessageID int
+}
+
+// AddModerationMessages records messages sent to the moderation group for a
+// post, so they can all be deleted once the post is moderated.
+func AddModerationMessages(db *sql.DB, postID int64, refs []MessageRef) error {
+	for _, ref := range refs {
+		_, err := db.Exec(`INSERT OR IGNORE INTO moderation_messages (post_id, chat_id, message_id) VALUES (?, ?, ?)`, postID, ref.ChatID, ref.MessageID)
+		if err != nil {
+			log.Printf("[ERROR] Exec AddModerationMessages: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetModerationMessages returns every moderation message of a post: the ones
+// recorded with AddModerationMessages and the one linked with
+// SetModerationMessage, which is all that posts from before the bundles have.
+func GetModerationMessages(db *sql.DB, postID int64) ([]MessageRef, error) {
+	rows, err := db.Query(`SELECT chat_id, message_id FROM moderation_messages WHERE post_id = ?
+		UNION SELECT moderation_chat_id, moderation_message_id FROM posts WHERE id = ? AND moderation_message_id IS NOT NULL
+		ORDER BY 2`, postID, postID)
+	if err != nil {
+		log.Printf("[ERROR] Query GetModerationMessages: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []MessageRef
+	for rows.Next() {
+		var ref MessageRef
+		if err := rows.Scan(&ref.ChatID, &ref.MessageID); err != nil {
+			log.Printf("[ERROR] Scan GetModerationMessages: %v", err)
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// DeleteModerationMessages forgets the moderation messages of a post, e.g.
+// before it is sent to moderation again.
+func DeleteModerationMessages(db *sql.DB, postID int64) error {
+	_, err := db.Exec(`DELETE FROM moderation_messages WHERE post_id = ?`, postID)
+	if err == nil {
+		_, err = db.Exec(`UPDATE posts SET moderation_chat_id = NULL, moderation_message_id = NULL WHERE id = ?`, postID)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Exec DeleteModerationMessages: %v", err)
+	}
+	return err
+}
+
+// FindPostByModerationMessage returns the ID of the post that chatID/messageID
+// belongs to: its keyboard message or any photo of its moderation album.
+func FindPostByModerationMessage(db *sql.DB, chatID int64, messageID int) (int64, error) {
+	var postID int64
+	err := db.QueryRow(`SELECT post_id FROM moderation_messages WHERE chat_id = ? AND message_id = ?
+		UNION SELECT id FROM posts WHERE moderation_chat_id = ? AND moderation_message_id = ?`,
+		chatID, messageID, chatID, messageID).Scan(&postID)
+	return postID, err
+}
+
+// Kinds of published messages.
+const (
+	PublishedText    = "text"
+	PublishedCaption = "caption"
+	PublishedPhoto   = "photo"
+)
+
+// PublishedMessage is one message of an approved listing in the sale group.
+// ThreadID is the forum topic it was posted in, or 0. Kind says whether it
+// holds the listing text, as a message or as the caption of its first
+// photo, or is one of the other photos.
+type PublishedMessage struct {
+	MessageRef
+	ThreadID int
+	Kind     string
+}
+
+// ErrPostNotPending is returned when a post was already moderated, e.g. by
+// another moderator in the meantime.
+var ErrPostNotPending = errors.New("post is no longer pending")
+
+// ErrPostNotExpired is returned when an expired listing was renewed or
+// otherwise changed in the meantime.
+var ErrPostNotExpired = errors.New("post is no longer expired")
+
+// ErrPostNotApproved is returned when a listing is no longer published.
+var ErrPostNotApproved = errors.New("post is no longer approved")
+
+// PublishPost marks a pending post approved and records the messages it was
+// published as at now, in one transaction, so an approved post always has
+// its messages on record. The listing's lifetime starts at now. It returns
+// ErrPostNotPending, and records nothing, if the post is no longer pending.
+func PublishPost(db *sql.DB, postID int64, msgs []PublishedMessage, now time.Time) error {
+	return publishPost(db, postID, "pending", ErrPostNotPending, msgs, now)
+}
+
+// RepublishPost is PublishPost for a listing that expired after it was
+// published. The messages of its previous publication are forgotten; it
+// returns them so the caller can delete whatever is left of them.
+func RepublishPost(db *sql.DB, postID int64, msgs []PublishedMessage, now time.Time) ([]PublishedMessage, error) {
+	old, err := GetPublishedMessages(db, postID)
+	if err != nil {
+		return nil, err
+	}
+	return old, publishPost(db, postID, "expired", ErrPostNotExpired, msgs, now)
+}
+
+func publishPost(db *sql.DB, postID int64, from string, errMoved error, msgs []PublishedMessage, now time.Time) error {
+	// Read the config before the transaction takes the connection
+	expiresAt := ListingExpiresAt(db, now)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE posts SET status = 'approved', published_at = ?, listing_expires_at = ?, reminded_at = NULL WHERE id = ? AND status = ?`,
+		FormatTime(now), FormatTime(expiresAt), postID, from)
+	if err != nil {
+		log.Printf("[ERROR] Exec PublishPost: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errMoved
+	}
+	if _, err := tx.Exec(`DELETE FROM published_messages WHERE post_id = ?`, postID); err != nil {
+		log.Printf("[ERROR] Exec PublishPost: %v", err)
+		return err
+	}
+	for _, msg := range msgs {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO published_messages (post_id, chat_id, thread_id, message_id, kind) VALUES (?, ?, ?, ?, ?)`, postID, msg.ChatID, nullInt(msg.ThreadID), msg.MessageID, msg.Kind)
+		if err != nil {
+			log.Printf("[ERROR] Exec PublishPost: %v", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ExtendListing starts a new lifetime at now for an approved listing.
+func ExtendListing(db *sql.DB, postID int64, now time.Time) error {
+	expiresAt := ListingExpiresAt(db, now)
+	res, err := db.Exec(`UPDATE posts SET listing_expires_at = ?, reminded_at = NULL WHERE id = ? AND status = 'approved'`, FormatTime(expiresAt), postID)
+	if err != nil {
+		log.Printf("[ERROR] Exec ExtendListing: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrPostNotApproved
+	}
+	return nil
+}
+
+// nullInt stores 0 as NULL.
+func nullInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// GetPublishedMessages returns the messages of a listing in the sale group,
+// in the order they were sent. Listings approved before they were recorded
+// have none.
+func GetPublishedMessages(db *sql.DB, postID int64) ([]PublishedMessage, error) {
+	rows, err := db.Query(`SELECT chat_id, COALESCE(thread_id, 0), message_id, kind FROM published_messages WHERE post_id = ? ORDER BY message_id`, postID)
+	if err != nil {
+		log.Printf("[ERROR] Query GetPublishedMessages: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []PublishedMessage
+	for rows.Next() {
+		var msg PublishedMessage
+		if err := rows.Scan(&msg.ChatID, &msg.ThreadID, &msg.MessageID, &msg.Kind); err != nil {
+			log.Printf("[ERROR] Scan GetPublishedMessages: %v", err)
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// DeletePublishedMessages forgets the messages of a listing once they have
+// been removed from the sale group.
+func DeletePublishedMessages(db *sql.DB, postID int64) error {
+	_, err := db.Exec(`DELETE FROM published_messages WHERE post_id = ?`, postID)
+	if err != nil {
+		log.Printf("[ERROR] Exec DeletePublishedMessages: %v", err)
+	}
+	return err
+}
+
+// GetUserLang returns the language stored for a user, or "" if none is set.
+func GetUserLang(db *sql.DB, userID int64) (string, error) {
+	var lang sql.NullString
+	err := db.QueryRow(`SELECT lang FROM users WHERE id = ?`, userID).Scan(&lang)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return lang.String, err
+}
+
+// SetUserLang stores a user's language, creating the user row if needed.
+func SetUserLang(db *sql.DB, userID int64, lang string) error {
+	_, err := db.Exec(`INSERT INTO users (id, lang) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET lang=excluded.lang`, userID, lang)
+	if err != nil {
+		log.Printf("[ERROR] Exec SetUserLang: %v", err)
+	}
+	return err
+}
+
+// TimeLayout is how SQLite's datetime() formats timestamps; values compared
+// against DATETIME columns must use it, in UTC.
+const TimeLayout = "2006-01-02 15:04:05"
+
+// FormatTime formats t for comparison with DATETIME columns.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
 // Config table helpers
 func GetConfig(db *sql.DB, key string) (string, error) {
 	var value string
@@ -69,3 +372,119 @@ func SetConfig(db *sql.DB, key, value string) error {
 	_, err := db.Exec(`INSERT INTO config (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value`, key, value)
 	return err
 }
+
+// SetConfigDefault sets key only if it has no value yet, so startup defaults
+// don't overwrite changes made later with /config.
+func SetConfigDefault(db *sql.DB, key, value string) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO config (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+// GetConfigInt reads a positive integer config value, falling back to def
+// when the key is missing or invalid.
+func GetConfigInt(db *sql.DB, key string, def int) int {
+	value, err := GetConfig(db, key)
+	if err != nil {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("[WARNING] Invalid %s %q, using %d", key, value, def)
+		return def
+	}
+	return n
+}
+
+const (
+	// DefaultTimeoutMinutes is how long a post waits for moderation when
+	// TIMEOUT_MINUTES is not set.
+	DefaultTimeoutMinutes = 1440
+	// DefaultPollSeconds is how often expired posts are checked for when
+	// EXPIRY_POLL_SECONDS is not set.
+	DefaultPollSeconds = 60
+	// DefaultMaxPhotos is how many photos a listing may have when MAX_PHOTOS
+	// is not set: one Telegram album.
+	DefaultMaxPhotos = 10
+	// DefaultListingLifetimeDays is how long an approved listing stays in
+	// the sale group when LISTING_LIFETIME_DAYS is not set.
+	DefaultListingLifetimeDays = 30
+	// DefaultListingReminderDays is how long before its expiry the seller is
+	// reminded when LISTING_REMINDER_DAYS is not set.
+	DefaultListingReminderDays = 3
+)
+
+// PendingTimeout is how long a post may wait for moderation. It is read from
+// the config table on every call, so /config TIMEOUT_MINUTES applies at once.
+func PendingTimeout(db *sql.DB) time.Duration {
+	return time.Duration(GetConfigInt(db, "TIMEOUT_MINUTES", DefaultTimeoutMinutes)) * time.Minute
+}
+
+// ExpiresAt is when a post submitted or escalated at now stops waiting for moderation.
+func ExpiresAt(db *sql.DB, now time.Time) time.Time {
+	return now.Add(PendingTimeout(db))
+}
+
+// ListingLifetime is how long an approved listing stays in the sale group.
+// Like PendingTimeout it is read on every call; a change applies to
+// listings published or renewed afterwards.
+func ListingLifetime(db *sql.DB) time.Duration {
+	return time.Duration(GetConfigInt(db, "LISTING_LIFETIME_DAYS", DefaultListingLifetimeDays)) * 24 * time.Hour
+}
+
+// ListingExpiresAt is when a listing published or renewed at now expires.
+func ListingExpiresAt(db *sql.DB, now time.Time) time.Time {
+	return now.Add(ListingLifetime(db))
+}
+
+// ListingReminder is how long before a listing expires its seller is
+// reminded.
+func ListingReminder(db *sql.DB) time.Duration {
+	return time.Duration(GetConfigInt(db, "LISTING_REMINDER_DAYS", DefaultListingReminderDays)) * 24 * time.Hour
+}
+
+// PollInterval is how often the expiration worker looks for expired posts.
+func PollInterval(db *sql.DB) time.Duration {
+	return time.Duration(GetConfigInt(db, "EXPIRY_POLL_SECONDS", DefaultPollSeconds)) * time.Second
+}
+
+// MaxPhotos is how many photos a seller may attach to one listing.
+func MaxPhotos(db *sql.DB) int {
+	return GetConfigInt(db, "MAX_PHOTOS", DefaultMaxPhotos)
+}
+
+// LengthLimit is how many characters a text field of a listing may have.
+type LengthLimit struct {
+	Min, Max int
+}
+
+// DefaultLengthLimits are the limits of the wizard's text fields when their
+// <FIELD>_MIN_LENGTH and <FIELD>_MAX_LENGTH config keys are not set.
+var DefaultLengthLimits = map[string]LengthLimit{
+	"title":       {Min: 3, Max: 100},
+	"description": {Min: 1, Max: 2000},
+	"price":       {Min: 1, Max: 50},
+	"location":    {Min: 2, Max: 100},
+}
+
+// LengthKeys returns the config keys holding the length limits of field.
+func LengthKeys(field string) (minKey, maxKey string) {
+	field = strings.ToUpper(field)
+	return field + "_MIN_LENGTH", field + "_MAX_LENGTH"
+}
+
+// FieldLength is the length limit of field, read from the config table on
+// every call so /config changes apply to the next message.
+func FieldLength(db *sql.DB, field string) LengthLimit {
+	def := DefaultLengthLimits[field]
+	minKey, maxKey := LengthKeys(field)
+	limit := LengthLimit{
+		Min: GetConfigInt(db, minKey, def.Min),
+		Max: GetConfigInt(db, maxKey, def.Max),
+	}
+	if limit.Min > limit.Max {
+		// Nothing would be accepted and the seller would be stuck
+		log.Printf("[WARNING] %s %d is above %s %d, using %d-%d", minKey, limit.Min, maxKey, limit.Max, def.Min, def.Max)
+		return def
+	}
+	return limit
+}
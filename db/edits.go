@@ -0,0 +1,219 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+// ErrEditNotPending is returned when an edit request was already decided.
+var ErrEditNotPending = errors.New("edit request is no longer pending")
+
+// ErrEditStale is returned when an edit request is approved after its listing
+// was sold, withdrawn or expired.
+var ErrEditStale = errors.New("listing of the edit request is no longer published")
+
+// execer is what *sql.DB and *sql.Tx have in common for writes.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// fieldColumns lists the columns that hold each field of a listing, in posts
+// and listing_edits alike. In a draft's PostData the values use the column
+// names as keys.
+var fieldColumns = map[string][]string{
+	"title":       {"title"},
+	"description": {"description"},
+	"price":       {"price", "price_amount", "price_currency", "price_kind"},
+	"location":    {"location"},
+}
+
+// changedColumns returns the columns of fields and their values in postData.
+func changedColumns(postData map[string]interface{}, fields []string) ([]string, []interface{}) {
+	var columns []string
+	var values []interface{}
+	for _, field := range fields {
+		for _, column := range fieldColumns[field] {
+			columns = append(columns, column)
+			values = append(values, postData[column])
+		}
+	}
+	return columns, values
+}
+
+// UpdatePostFields overwrites fields of a post, e.g. "title" or "price",
+// with their values in postData, keyed like a draft's PostData. The other
+// fields are left alone.
+func UpdatePostFields(db *sql.DB, postID int64, postData map[string]interface{}, fields []string) error {
+	return updatePostFields(db, postID, postData, fields)
+}
+
+func updatePostFields(exec execer, postID int64, postData map[string]interface{}, fields []string) error {
+	columns, values := changedColumns(postData, fields)
+	if len(columns) == 0 {
+		return nil
+	}
+	_, err := exec.Exec(`UPDATE posts SET `+strings.Join(columns, " = ?, ")+` = ? WHERE id = ?`, append(values, postID)...)
+	if err != nil {
+		log.Printf("[ERROR] Exec UpdatePostFields: %v", err)
+	}
+	return err
+}
+
+// SaveListingEdit stores the changed fields of a post as a pending edit
+// request and returns its ID. Older pending requests stay pending until
+// SupersedeListingEdits, so they survive if this one never reaches the
+// moderators.
+func SaveListingEdit(db *sql.DB, postID int64, postData map[string]interface{}, fields []string) (int64, error) {
+	columns, values := changedColumns(postData, fields)
+	placeholders := strings.Repeat(", ?", len(columns))
+	res, err := db.Exec(`INSERT INTO listing_edits (post_id, fields`+prefixed(columns)+`) VALUES (?, ?`+placeholders+`)`,
+		append([]interface{}{postID, strings.Join(fields, ",")}, values...)...)
+	if err != nil {
+		log.Printf("[ERROR] Exec SaveListingEdit: %v", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// prefixed turns columns into ", a, b" for a column list.
+func prefixed(columns []string) string {
+	if len(columns) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(columns, ", ")
+}
+
+// SupersedeListingEdits marks every pending edit request of a post except
+// keepID as superseded and returns their moderation messages.
+func SupersedeListingEdits(db *sql.DB, postID, keepID int64) ([]MessageRef, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT moderation_chat_id, moderation_message_id FROM listing_edits WHERE post_id = ? AND id != ? AND status = 'pending' AND moderation_message_id IS NOT NULL`, postID, keepID)
+	if err != nil {
+		log.Printf("[ERROR] Query SupersedeListingEdits: %v", err)
+		return nil, err
+	}
+	var superseded []MessageRef
+	for rows.Next() {
+		var ref MessageRef
+		if err := rows.Scan(&ref.ChatID, &ref.MessageID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		superseded = append(superseded, ref)
+	}
+	rows.Close()
+	if _, err := tx.Exec(`UPDATE listing_edits SET status = 'superseded' WHERE post_id = ? AND id != ? AND status = 'pending'`, postID, keepID); err != nil {
+		log.Printf("[ERROR] Exec SupersedeListingEdits: %v", err)
+		return nil, err
+	}
+	return superseded, tx.Commit()
+}
+
+// DeleteListingEdit drops an edit request that never reached the moderators.
+func DeleteListingEdit(db *sql.DB, editID int64) error {
+	_, err := db.Exec(`DELETE FROM listing_edits WHERE id = ? AND status = 'pending'`, editID)
+	if err != nil {
+		log.Printf("[ERROR] Exec DeleteListingEdit: %v", err)
+	}
+	return err
+}
+
+// SetListingEditMessage links an edit request to the message that asks the
+// moderators about it.
+func SetListingEditMessage(db *sql.DB, editID, chatID int64, messageID int) error {
+	_, err := db.Exec(`UPDATE listing_edits SET moderation_chat_id = ?, moderation_message_id = ? WHERE id = ?`, chatID, messageID, editID)
+	if err != nil {
+		log.Printf("[ERROR] Exec SetListingEditMessage: %v", err)
+	}
+	return err
+}
+
+// ApplyListingEdit approves a pending edit request and writes the fields it
+// changed to its post, in one transaction, and returns the post's ID. Like
+// moderating a post, it fails with ErrEditNotPending if another moderator
+// was faster. If the post is no longer approved, the request is marked
+// stale instead and ErrEditStale returned.
+func ApplyListingEdit(db *sql.DB, editID int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var postID int64
+	var fields, postStatus string
+	var title, description, price, priceCurrency, priceKind, location sql.NullString
+	var priceAmount sql.NullInt64
+	err = tx.QueryRow(`SELECT e.post_id, e.fields, p.status, e.title, e.description, e.price, e.price_amount, e.price_currency, e.price_kind, e.location
+		FROM listing_edits e JOIN posts p ON p.id = e.post_id WHERE e.id = ? AND e.status = 'pending'`, editID).
+		Scan(&postID, &fields, &postStatus, &title, &description, &price, &priceAmount, &priceCurrency, &priceKind, &location)
+	if err == sql.ErrNoRows {
+		return 0, ErrEditNotPending
+	}
+	if err != nil {
+		log.Printf("[ERROR] Scan ApplyListingEdit: %v", err)
+		return 0, err
+	}
+	if postStatus != "approved" {
+		if _, err := tx.Exec(`UPDATE listing_edits SET status = 'stale' WHERE id = ?`, editID); err != nil {
+			log.Printf("[ERROR] Exec ApplyListingEdit: %v", err)
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return postID, ErrEditStale
+	}
+	postData := map[string]interface{}{
+		"title":          nullValue(title),
+		"description":    nullValue(description),
+		"price":          nullValue(price),
+		"price_currency": nullValue(priceCurrency),
+		"price_kind":     nullValue(priceKind),
+		"location":       nullValue(location),
+	}
+	if priceAmount.Valid {
+		postData["price_amount"] = priceAmount.Int64
+	}
+	if _, err := tx.Exec(`UPDATE listing_edits SET status = 'approved' WHERE id = ?`, editID); err != nil {
+		log.Printf("[ERROR] Exec ApplyListingEdit: %v", err)
+		return 0, err
+	}
+	if err := updatePostFields(tx, postID, postData, strings.Split(fields, ",")); err != nil {
+		return 0, err
+	}
+	return postID, tx.Commit()
+}
+
+// nullValue is the value of s for an Exec argument: its string, or nil.
+func nullValue(s sql.NullString) interface{} {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
+
+// RejectListingEdit marks a pending edit request rejected and returns the
+// post it belongs to. It fails with ErrEditNotPending if the request was
+// already decided.
+func RejectListingEdit(db *sql.DB, editID int64) (int64, error) {
+	res, err := db.Exec(`UPDATE listing_edits SET status = 'rejected' WHERE id = ? AND status = 'pending'`, editID)
+	if err != nil {
+		log.Printf("[ERROR] Exec RejectListingEdit: %v", err)
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, ErrEditNotPending
+	}
+	var postID int64
+	if err := db.QueryRow(`SELECT post_id FROM listing_edits WHERE id = ?`, editID).Scan(&postID); err != nil {
+		log.Printf("[ERROR] Scan RejectListingEdit: %v", err)
+		return 0, err
+	}
+	return postID, nil
+}
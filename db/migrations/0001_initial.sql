@@ -0,0 +1,31 @@
+-- Schema as created by GoSaleBot 0.1.0. IF NOT EXISTS lets databases created
+-- before migrations existed adopt it as version 1.
+CREATE TABLE IF NOT EXISTS posts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	chat_id INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected')),
+	title TEXT,
+	description TEXT,
+	price TEXT,
+	location TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS photos (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+	file_id TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS config (
+	key TEXT PRIMARY KEY,
+	value TEXT
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY,
+	username TEXT
+);
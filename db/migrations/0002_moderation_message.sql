@@ -0,0 +1,3 @@
+-- Link each post to its message in the moderation group.
+ALTER TABLE posts ADD COLUMN moderation_chat_id INTEGER;
+ALTER TABLE posts ADD COLUMN moderation_message_id INTEGER;
@@ -0,0 +1,8 @@
+-- Wizard sessions, so drafts survive a restart.
+CREATE TABLE sessions (
+	user_id INTEGER PRIMARY KEY,
+	state INTEGER NOT NULL,
+	post_data TEXT NOT NULL,
+	editing INTEGER NOT NULL DEFAULT 0,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
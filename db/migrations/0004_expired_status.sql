@@ -0,0 +1,21 @@
+-- Allow the 'expired' status. SQLite can't alter a CHECK constraint, so the
+-- table is rebuilt; photos keeps referencing it by name.
+CREATE TABLE posts_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	chat_id INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected', 'expired')),
+	title TEXT,
+	description TEXT,
+	price TEXT,
+	location TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME,
+	moderation_chat_id INTEGER,
+	moderation_message_id INTEGER
+);
+INSERT INTO posts_new (id, user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at, moderation_chat_id, moderation_message_id)
+	SELECT id, user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at, moderation_chat_id, moderation_message_id FROM posts;
+DROP TABLE posts;
+ALTER TABLE posts_new RENAME TO posts;
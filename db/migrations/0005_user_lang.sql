@@ -0,0 +1,2 @@
+-- Per-user interface language; NULL until detected or chosen with /language.
+ALTER TABLE users ADD COLUMN lang TEXT;
@@ -0,0 +1,10 @@
+-- Every message of a post's moderation bundle (photo album and the message
+-- with the Approve/Reject keyboard), so all of them can be cleaned up.
+-- posts.moderation_message_id keeps pointing at the keyboard message.
+CREATE TABLE moderation_messages (
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    chat_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    PRIMARY KEY (chat_id, message_id)
+);
+CREATE INDEX idx_moderation_messages_post ON moderation_messages(post_id);
@@ -0,0 +1,8 @@
+-- Keep what Telegram tells us about each photo. file_unique_id is the same
+-- for the same file whoever sends it, so reused photos can be detected.
+ALTER TABLE photos ADD COLUMN file_unique_id TEXT;
+ALTER TABLE photos ADD COLUMN width INTEGER;
+ALTER TABLE photos ADD COLUMN height INTEGER;
+ALTER TABLE photos ADD COLUMN file_size INTEGER;
+ALTER TABLE photos ADD COLUMN is_document INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX idx_photos_file_unique_id ON photos(file_unique_id);
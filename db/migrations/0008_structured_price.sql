@@ -0,0 +1,6 @@
+-- Parsed price next to the text the seller typed (kept in price). Amounts
+-- are in hundredths of the currency unit. NULL for posts from before.
+ALTER TABLE posts ADD COLUMN price_amount INTEGER;
+ALTER TABLE posts ADD COLUMN price_currency TEXT;
+ALTER TABLE posts ADD COLUMN price_kind TEXT CHECK(price_kind IN ('fixed', 'free', 'negotiable'));
+CREATE INDEX idx_posts_price ON posts(price_currency, price_amount);
@@ -0,0 +1,39 @@
+-- Allow the 'sold' and 'withdrawn' statuses sellers set from /mylistings.
+-- SQLite can't alter a CHECK constraint, so the table is rebuilt as in 0004.
+CREATE TABLE posts_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	chat_id INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected', 'expired', 'sold', 'withdrawn')),
+	title TEXT,
+	description TEXT,
+	price TEXT,
+	price_amount INTEGER,
+	price_currency TEXT,
+	price_kind TEXT CHECK(price_kind IN ('fixed', 'free', 'negotiable')),
+	location TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME,
+	moderation_chat_id INTEGER,
+	moderation_message_id INTEGER
+);
+INSERT INTO posts_new (id, user_id, chat_id, message_id, status, title, description, price, price_amount, price_currency, price_kind, location, created_at, expires_at, moderation_chat_id, moderation_message_id)
+	SELECT id, user_id, chat_id, message_id, status, title, description, price, price_amount, price_currency, price_kind, location, created_at, expires_at, moderation_chat_id, moderation_message_id FROM posts;
+DROP TABLE posts;
+ALTER TABLE posts_new RENAME TO posts;
+CREATE INDEX idx_posts_price ON posts(price_currency, price_amount);
+CREATE INDEX idx_posts_user ON posts(user_id);
+
+-- The messages of an approved listing in the sale group, so the seller can
+-- later mark it sold or withdraw it. kind is 'text' for a message holding
+-- the listing text, 'caption' for the photo holding it as its caption and
+-- 'photo' for the other photos.
+CREATE TABLE published_messages (
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    chat_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    kind TEXT NOT NULL CHECK(kind IN ('text', 'caption', 'photo')),
+    PRIMARY KEY (chat_id, message_id)
+);
+CREATE INDEX idx_published_messages_post ON published_messages(post_id);
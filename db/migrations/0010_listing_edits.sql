@@ -0,0 +1,19 @@
+-- Changes sellers make to approved listings that need moderation. Each row
+-- holds the complete new version; the post is only updated once a moderator
+-- approves it. A newer request for the same post supersedes a pending one.
+CREATE TABLE listing_edits (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected', 'superseded')),
+    title TEXT,
+    description TEXT,
+    price TEXT,
+    price_amount INTEGER,
+    price_currency TEXT,
+    price_kind TEXT CHECK(price_kind IN ('fixed', 'free', 'negotiable')),
+    location TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    moderation_chat_id INTEGER,
+    moderation_message_id INTEGER
+);
+CREATE INDEX idx_listing_edits_post ON listing_edits(post_id);
@@ -0,0 +1,5 @@
+-- The forum topic a published message was posted in (NULL outside topics),
+-- so replies, bumps and reposts can go to the same topic. Listings approved
+-- before 0009 have no published_messages rows; their message IDs were never
+-- kept.
+ALTER TABLE published_messages ADD COLUMN thread_id INTEGER;
@@ -0,0 +1,14 @@
+-- How long an approved listing stays in the sale group, separate from the
+-- moderation timeout in expires_at. published_at is when the listing was
+-- last published and stays set after it expires, so a renewal can publish
+-- it again without another moderation round. reminded_at is when the seller
+-- was reminded of the coming expiry.
+ALTER TABLE posts ADD COLUMN published_at DATETIME;
+ALTER TABLE posts ADD COLUMN listing_expires_at DATETIME;
+ALTER TABLE posts ADD COLUMN reminded_at DATETIME;
+-- Listings published before lifetimes existed get a fixed 30-day lifetime
+-- from the upgrade on, instead of vanishing at once; LISTING_LIFETIME_DAYS
+-- only applies to listings published or renewed afterwards.
+UPDATE posts SET published_at = created_at, listing_expires_at = datetime('now', '+30 days')
+	WHERE status IN ('approved', 'sold');
+CREATE INDEX idx_posts_listing_expires ON posts(status, listing_expires_at);
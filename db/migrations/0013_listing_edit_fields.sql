@@ -0,0 +1,26 @@
+-- Edit requests now only hold the fields the seller changed, listed in
+-- fields (comma-separated, e.g. 'title,description'); the other columns are
+-- NULL. 'stale' marks requests whose listing was no longer published when a
+-- moderator approved them. The table is rebuilt for the new CHECK, as in
+-- 0009. Older requests hold complete versions, so they list every field.
+CREATE TABLE listing_edits_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'approved', 'rejected', 'superseded', 'stale')),
+    fields TEXT NOT NULL,
+    title TEXT,
+    description TEXT,
+    price TEXT,
+    price_amount INTEGER,
+    price_currency TEXT,
+    price_kind TEXT CHECK(price_kind IN ('fixed', 'free', 'negotiable')),
+    location TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    moderation_chat_id INTEGER,
+    moderation_message_id INTEGER
+);
+INSERT INTO listing_edits_new (id, post_id, status, fields, title, description, price, price_amount, price_currency, price_kind, location, created_at, moderation_chat_id, moderation_message_id)
+	SELECT id, post_id, status, 'title,description,price,location', title, description, price, price_amount, price_currency, price_kind, location, created_at, moderation_chat_id, moderation_message_id FROM listing_edits;
+DROP TABLE listing_edits;
+ALTER TABLE listing_edits_new RENAME TO listing_edits;
+CREATE INDEX idx_listing_edits_post ON listing_edits(post_id);
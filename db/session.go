@@ -0,0 +1,128 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"gosalebot/fsm"
+)
+
+// SessionStore is the SQLite implementation of fsm.Store.
+type SessionStore struct {
+	db *sql.DB
+}
+
+func NewSessionStore(db *sql.DB) *SessionStore {
+	return &SessionStore{db: db}
+}
+
+func (s *SessionStore) LoadSessions() (map[int64]*fsm.UserSession, error) {
+	rows, err := s.db.Query(`SELECT user_id, state, post_data, editing FROM sessions`)
+	if err != nil {
+		log.Printf("[ERROR] Query LoadSessions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make(map[int64]*fsm.UserSession)
+	for rows.Next() {
+		var userID int64
+		var state int
+		var raw string
+		var editing bool
+		if err := rows.Scan(&userID, &state, &raw, &editing); err != nil {
+			log.Printf("[ERROR] Scan LoadSessions: %v", err)
+			return nil, err
+		}
+		postData, err := decodePostData(raw)
+		if err != nil {
+			log.Printf("[WARNING] Dropping unreadable session for user %d: %v", userID, err)
+			continue
+		}
+		sessions[userID] = &fsm.UserSession{UserID: userID, State: state, PostData: postData, Editing: editing}
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SessionStore) SaveSession(session *fsm.UserSession) error {
+	raw, err := json.Marshal(session.PostData)
+	if err != nil {
+		log.Printf("[ERROR] Marshal SaveSession: %v", err)
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (user_id, state, post_data, editing, updated_at) VALUES (?, ?, ?, ?, datetime('now'))
+		ON CONFLICT(user_id) DO UPDATE SET state=excluded.state, post_data=excluded.post_data, editing=excluded.editing, updated_at=excluded.updated_at`,
+		session.UserID, session.State, string(raw), session.Editing)
+	if err != nil {
+		log.Printf("[ERROR] Exec SaveSession: %v", err)
+	}
+	return err
+}
+
+func (s *SessionStore) DeleteSession(userID int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		log.Printf("[ERROR] Exec DeleteSession: %v", err)
+	}
+	return err
+}
+
+// decodePostData restores the Go types the FSM expects: JSON turns slices
+// into []interface{} and integers into floats, so both are converted back.
+// Photos become []fsm.Photo, including drafts saved when they were plain
+// file IDs.
+func decodePostData(raw string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.UseNumber()
+	postData := make(map[string]interface{})
+	if err := dec.Decode(&postData); err != nil {
+		return nil, err
+	}
+	for key, value := range postData {
+		if key == "photos" || key == fsm.PhotosBeforeEdit {
+			photos, err := decodePhotos(value)
+			if err != nil {
+				return nil, err
+			}
+			postData[key] = photos
+			continue
+		}
+		switch v := value.(type) {
+		case []interface{}:
+			strs := make([]string, 0, len(v))
+			for _, item := range v {
+				if str, ok := item.(string); ok {
+					strs = append(strs, str)
+				}
+			}
+			postData[key] = strs
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				postData[key] = n
+			}
+		}
+	}
+	return postData, nil
+}
+
+func decodePhotos(value interface{}) ([]fsm.Photo, error) {
+	items, _ := value.([]interface{})
+	photos := make([]fsm.Photo, 0, len(items))
+	for _, item := range items {
+		if fileID, ok := item.(string); ok {
+			photos = append(photos, fsm.Photo{FileID: fileID})
+			continue
+		}
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		var photo fsm.Photo
+		if err := json.Unmarshal(raw, &photo); err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
+)
+
+// dispatcher fans updates out to a fixed pool of workers. Updates with the
+// same key always land on the same worker, so each user's (or the moderation
+// group's) updates are handled in order while different users run in parallel.
+type dispatcher struct {
+	queues []chan tgbotapi.Update
+	keyFn  func(tgbotapi.Update) int64
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(workers, queueSize int, keyFn func(tgbotapi.Update) int64, handle func(tgbotapi.Update)) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &dispatcher{queues: make([]chan tgbotapi.Update, workers), keyFn: keyFn}
+	for i := range d.queues {
+		queue := make(chan tgbotapi.Update, queueSize)
+		d.queues[i] = queue
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for update := range queue {
+				handle(update)
+			}
+		}()
+	}
+	return d
+}
+
+// Dispatch queues update on the worker that owns its key. It blocks when that
+// worker's queue is full.
+func (d *dispatcher) Dispatch(update tgbotapi.Update) {
+	key := uint64(d.keyFn(update))
+	d.queues[key%uint64(len(d.queues))] <- update
+}
+
+// Close stops accepting updates and waits for queued ones to be handled.
+func (d *dispatcher) Close() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+// updateKey picks the serialization key for an update: everything happening
+// in the moderation group shares the group's chat ID, so two moderators can't
+// act on the same post at once; everything else is keyed by the sending user.
+func updateKey(update tgbotapi.Update, moderationGroupID int64) int64 {
+	if cb := update.CallbackQuery; cb != nil {
+		if cb.Message != nil && cb.Message.Chat != nil && cb.Message.Chat.ID == moderationGroupID {
+			return moderationGroupID
+		}
+		if cb.From != nil {
+			return cb.From.ID
+		}
+	}
+	if msg := update.Message; msg != nil {
+		if msg.Chat != nil && msg.Chat.ID == moderationGroupID {
+			return moderationGroupID
+		}
+		if msg.From != nil {
+			return msg.From.ID
+		}
+		if msg.Chat != nil {
+			return msg.Chat.ID
+		}
+	}
+	return 0
+}
@@ -1,11 +1,36 @@
 package fsm
 
+import (
+	"log"
+	"sync"
+)
+
 type UserSession struct {
 	UserID   int64
 	State    int
 	PostData map[string]interface{}
+	// Editing is set while the user changes a single field from the
+	// preview; the wizard then returns to the preview instead of moving on.
+	Editing bool
 }
 
+// Photo is one picture of a draft, stored under PostData["photos"] as a
+// []Photo. Document is set for images the seller sent as files; Telegram
+// only lets those be resent as documents.
+type Photo struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	Document     bool   `json:"document,omitempty"`
+}
+
+// PhotosBeforeEdit holds the draft's photos, as a []Photo, while the user
+// replaces them from the preview, so /back can restore them until the first
+// new photo arrives.
+const PhotosBeforeEdit = "photos_before_edit"
+
 const (
 	StateIdle = iota
 	StateTitle
@@ -16,4 +41,85 @@ const (
 	StatePreview
 )
 
-var Sessions = make(map[int64]*UserSession)
+// sessions holds every active session. It is shared by all update workers,
+// so it must only be accessed through the functions below. A single session
+// is only ever touched by the worker that owns its user.
+var (
+	mu       sync.RWMutex
+	sessions = make(map[int64]*UserSession)
+)
+
+// Get returns the session for userID, if there is one.
+func Get(userID int64) (*UserSession, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	session, ok := sessions[userID]
+	return session, ok
+}
+
+// GetOrCreate returns the session for userID, creating an idle one if needed.
+// created reports whether a new session was made.
+func GetOrCreate(userID int64) (session *UserSession, created bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if session, ok := sessions[userID]; ok {
+		return session, false
+	}
+	session = &UserSession{UserID: userID, State: StateIdle, PostData: make(map[string]interface{})}
+	sessions[userID] = session
+	return session, true
+}
+
+// Delete forgets the in-memory session for userID. It does not touch the store.
+func Delete(userID int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(sessions, userID)
+}
+
+// Store persists sessions so in-progress drafts survive a restart.
+type Store interface {
+	LoadSessions() (map[int64]*UserSession, error)
+	SaveSession(session *UserSession) error
+	DeleteSession(userID int64) error
+}
+
+var store Store
+
+// UseStore installs s as the session store and loads every saved session
+// into memory. Passing nil disables persistence. It must be called before
+// updates are dispatched to workers.
+func UseStore(s Store) error {
+	store = s
+	if s == nil {
+		return nil
+	}
+	loaded, err := s.LoadSessions()
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	for userID, session := range loaded {
+		sessions[userID] = session
+	}
+	mu.Unlock()
+	log.Printf("[INFO] Loaded %d session(s) from store", len(loaded))
+	return nil
+}
+
+// Save persists session through the configured store, if any. Idle sessions
+// without a draft are removed from the store instead of being saved.
+func Save(session *UserSession) {
+	if store == nil || session == nil {
+		return
+	}
+	var err error
+	if session.State == StateIdle && len(session.PostData) == 0 {
+		err = store.DeleteSession(session.UserID)
+	} else {
+		err = store.SaveSession(session)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to persist session for user %d: %v", session.UserID, err)
+	}
+}
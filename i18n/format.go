@@ -0,0 +1,303 @@
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Args holds the named parameters of a message.
+type Args map[string]interface{}
+
+// Messages use a subset of the ICU MessageFormat syntax:
+//
+//	{name}                                    the value of name
+//	{n, plural, =0 {none} one {# photo} other {# photos}}
+//	{gender, select, female {...} other {...}}
+//
+// Inside a plural case, # is replaced by the number. Plural cases are
+// "=N" for an exact value or a category of the language (see pluralRules);
+// both plural and select need an "other" case. Apostrophes have no special
+// meaning, unlike in ICU.
+//
+// In right-to-left languages every value and every # is wrapped in a Unicode
+// bidi isolate, so a Latin title, a price or an @username keeps its own
+// direction and does not reorder the Hebrew text around it.
+
+// part is a piece of a parsed message: literal text, a "#", or an argument.
+type part struct {
+	text  string
+	hash  bool
+	arg   string
+	kind  string // "", "plural" or "select"
+	cases map[string][]part
+}
+
+// parse splits msg into parts. inPlural makes "#" special.
+func parse(msg string, inPlural bool) ([]part, error) {
+	var parts []part
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			parts = append(parts, part{text: text.String()})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(msg); i++ {
+		switch c := msg[i]; {
+		case c == '{':
+			end, err := matchBrace(msg, i)
+			if err != nil {
+				return nil, err
+			}
+			arg, err := parseArg(msg[i+1 : end])
+			if err != nil {
+				return nil, err
+			}
+			flush()
+			parts = append(parts, arg)
+			i = end
+		case c == '}':
+			return nil, fmt.Errorf("unexpected } at offset %d", i)
+		case c == '#' && inPlural:
+			flush()
+			parts = append(parts, part{hash: true})
+		default:
+			text.WriteByte(c)
+		}
+	}
+	flush()
+	return parts, nil
+}
+
+// matchBrace returns the index of the } closing the { at msg[open].
+func matchBrace(msg string, open int) (int, error) {
+	depth := 0
+	for i := open; i < len(msg); i++ {
+		switch msg[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unclosed { at offset %d", open)
+}
+
+// parseArg parses the inside of an argument: "name" or "name, kind, cases".
+func parseArg(body string) (part, error) {
+	name, rest, complex := strings.Cut(body, ",")
+	p := part{arg: strings.TrimSpace(name)}
+	if p.arg == "" || strings.ContainsAny(p.arg, " {}") {
+		return p, fmt.Errorf("invalid argument name %q", name)
+	}
+	if !complex {
+		return p, nil
+	}
+	kind, rest, ok := strings.Cut(rest, ",")
+	p.kind = strings.TrimSpace(kind)
+	if !ok || (p.kind != "plural" && p.kind != "select") {
+		return p, fmt.Errorf("argument %q: expected plural or select", p.arg)
+	}
+	p.cases = make(map[string][]part)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		open := strings.IndexByte(rest, '{')
+		if open <= 0 {
+			return p, fmt.Errorf("argument %q: expected selector {message}", p.arg)
+		}
+		selector := strings.TrimSpace(rest[:open])
+		end, err := matchBrace(rest, open)
+		if err != nil {
+			return p, err
+		}
+		msg, err := parse(rest[open+1:end], p.kind == "plural")
+		if err != nil {
+			return p, err
+		}
+		p.cases[selector] = msg
+		rest = rest[end+1:]
+	}
+	if _, ok := p.cases["other"]; !ok {
+		return p, fmt.Errorf("argument %q: missing other case", p.arg)
+	}
+	return p, nil
+}
+
+// format renders parts in lang. hash is what "#" stands for.
+func format(b *strings.Builder, lang string, parts []part, args Args, hash string) {
+	for _, p := range parts {
+		switch {
+		case p.hash:
+			b.WriteString(hash)
+		case p.arg == "":
+			b.WriteString(p.text)
+		default:
+			value, ok := args[p.arg]
+			if !ok {
+				// Leave the placeholder visible rather than guess
+				b.WriteString("{" + p.arg + "}")
+				continue
+			}
+			switch p.kind {
+			case "plural":
+				n, _ := toInt(value)
+				format(b, lang, pluralCase(lang, p.cases, n), args, isolate(lang, n))
+			case "select":
+				c, ok := p.cases[fmt.Sprint(value)]
+				if !ok {
+					c = p.cases["other"]
+				}
+				format(b, lang, c, args, hash)
+			default:
+				b.WriteString(isolate(lang, value))
+			}
+		}
+	}
+}
+
+// Unicode bidi isolates (UAX #9).
+const (
+	lri = "\u2066" // left-to-right isolate
+	fsi = "\u2068" // first-strong isolate
+	pdi = "\u2069" // pop directional isolate
+)
+
+// rtlLocales are the locales written right to left.
+var rtlLocales = map[string]bool{
+	"he": true,
+	"ar": true,
+	"fa": true,
+}
+
+// RTL reports whether lang is written right to left.
+func RTL(lang string) bool {
+	return rtlLocales[lang]
+}
+
+// isolate formats value for insertion into a message in lang. In RTL
+// languages text takes the direction of its first strong character and
+// numbers are always left to right.
+func isolate(lang string, value interface{}) string {
+	s := fmt.Sprint(value)
+	if !RTL(lang) || s == "" {
+		return s
+	}
+	if _, ok := toInt(value); ok {
+		if _, isString := value.(string); !isString {
+			return lri + s + pdi
+		}
+	}
+	return fsi + s + pdi
+}
+
+func pluralCase(lang string, cases map[string][]part, n int64) []part {
+	if c, ok := cases["="+strconv.FormatInt(n, 10)]; ok {
+		return c
+	}
+	if c, ok := cases[pluralCategory(lang, n)]; ok {
+		return c
+	}
+	return cases["other"]
+}
+
+func toInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// pluralRules are the CLDR cardinal categories each language uses for whole
+// numbers, other than "other". Languages not listed follow English.
+var pluralRules = map[string][]string{
+	"en": {"one"},
+	"cz": {"one", "few"},
+	"he": {"one", "two"},
+}
+
+// pluralCategory returns the CLDR plural category of the whole number n.
+func pluralCategory(lang string, n int64) string {
+	switch lang {
+	case "cz":
+		switch {
+		case n == 1:
+			return "one"
+		case n >= 2 && n <= 4:
+			return "few"
+		}
+	case "he":
+		switch n {
+		case 1:
+			return "one"
+		case 2:
+			return "two"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
+
+// params lists the argument names used in parts, sorted and without duplicates.
+func params(parts []part) []string {
+	seen := make(map[string]bool)
+	var walk func([]part)
+	walk = func(parts []part) {
+		for _, p := range parts {
+			if p.arg == "" {
+				continue
+			}
+			seen[p.arg] = true
+			for _, c := range p.cases {
+				walk(c)
+			}
+		}
+	}
+	walk(parts)
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingPlurals lists the plural categories of lang that a plural argument
+// in parts has no case for.
+func missingPlurals(lang string, parts []part) []string {
+	var missing []string
+	for _, p := range parts {
+		for _, c := range p.cases {
+			missing = append(missing, missingPlurals(lang, c)...)
+		}
+		if p.kind != "plural" {
+			continue
+		}
+		categories, ok := pluralRules[lang]
+		if !ok {
+			categories = pluralRules["en"]
+		}
+		for _, category := range categories {
+			if _, ok := p.cases[category]; !ok {
+				missing = append(missing, fmt.Sprintf("{%s} %s", p.arg, category))
+			}
+		}
+	}
+	return missing
+}
@@ -1,85 +1,193 @@
 package i18n
 
 import (
+	"embed"
+	"encoding/json"
 	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
-var Messages = map[string]map[string]string{
-	"en": {
-		"welcome":                   "Welcome! Let's create a sale post. Please enter the title:",
-		"start":                     "Send /start to begin creating a sale post.",
-		"enter_description":         "Enter a description:",
-		"enter_price":               "Enter the price:",
-		"enter_location":            "Enter the location:",
-		"send_photos":               "Send one or more photos (type 'done' when finished):",
-		"photo_received":            "Photo received. Send another or type 'done'.",
-		"preview":                   "Preview:\nTitle: %s\nDescription: %s\nPrice: %s\nLocation: %s\nPhotos: %d",
-		"moderation_preview":        "New Sale Post:\nTitle: %s\nDescription: %s\nPrice: %s\nLocation: %s\nStatus: pending",
-		"post_submitted":            "Post submitted for moderation!",
-		"post_sent_for_approval":    "Post sent for approval!",
-		"send_photo_or_done":        "Send a photo or type 'done' when finished.",
-		"failed_save":               "Failed to save post. Please try again.",
-		"post_saved_failed_forward": "Post saved, but failed to forward to moderation group.",
-		"post_cancelled":            "Post creation cancelled.",
-		"send_confirm_or_cancel":    "Send 'confirm' to submit or 'cancel' to abort.",
-		"session_reset":             "Session reset. Send /start to begin.",
-		"post_rejected":             "Your post was rejected: %s",
-		"for_sale":                  "FOR SALE!\nTitle: %s\nDescription: %s\nPrice: %s\nLocation: %s\nPosted by: %s",
-	},
-	"cz": {
-		"welcome":                   "Vítejte! Pojďme vytvořit prodejní příspěvek. Zadejte prosím název:",
-		"start":                     "Pošlete /start pro zahájení vytváření prodejního příspěvku.",
-		"enter_description":         "Zadejte popis:",
-		"enter_price":               "Zadejte cenu:",
-		"enter_location":            "Zadejte lokalitu:",
-		"send_photos":               "Pošlete jednu nebo více fotografií (napište 'done' až skončíte):",
-		"photo_received":            "Fotografie přijata. Pošlete další nebo napište 'done'.",
-		"preview":                   "Náhled:\nNázev: %s\nPopis: %s\nCena: %s\nLokalita: %s\nFotografií: %d\nPošlete 'confirm' pro odeslání nebo 'cancel' pro zrušení.",
-		"send_photo_or_done":        "Pošlete fotografii nebo napište 'done' až skončíte.",
-		"failed_save":               "Nepodařilo se uložit příspěvek. Zkuste to prosím znovu.",
-		"post_saved_failed_forward": "Příspěvek uložen, ale nepodařilo se jej předat ke schválení.",
-		"post_submitted":            "Příspěvek byl odeslán ke schválení!",
-		"post_cancelled":            "Vytváření příspěvku bylo zrušeno.",
-		"send_confirm_or_cancel":    "Pošlete 'confirm' pro odeslání nebo 'cancel' pro zrušení.",
-		"session_reset":             "Relace byla resetována. Pošlete /start pro zahájení.",
-		"post_rejected":             "Váš příspěvek byl zamítnut: %s",
-	},
-	"he": {
-		"welcome":                   "ברוך הבא! בוא ניצור פוסט מכירה. אנא הכנס כותרת:",
-		"start":                     "שלח /start כדי להתחיל ליצור פוסט מכירה.",
-		"enter_description":         "הכנס תיאור:",
-		"enter_price":               "הכנס מחיר:",
-		"enter_location":            "הכנס מיקום:",
-		"send_photos":               "שלח תמונה אחת או יותר (כתוב 'done' כשתסיים):",
-		"photo_received":            "התמונה התקבלה. שלח עוד או כתוב 'done'.",
-		"preview":                   "תצוגה מקדימה:\nכותרת: %s\nתיאור: %s\nמחיר: %s\nמיקום: %s\nמספר תמונות: %d\nשלח 'confirm' לאישור או 'cancel' לביטול.",
-		"send_photo_or_done":        "שלח תמונה או כתוב 'done' כשתסיים.",
-		"failed_save":               "שמירת הפוסט נכשלה. נסה שוב.",
-		"post_saved_failed_forward": "הפוסט נשמר, אך לא נשלח לקבוצת המנהלים.",
-		"post_submitted":            "הפוסט נשלח לאישור!",
-		"post_cancelled":            "יצירת הפוסט בוטלה.",
-		"send_confirm_or_cancel":    "שלח 'confirm' לאישור או 'cancel' לביטול.",
-		"session_reset":             "הסשן אופס. שלח /start כדי להתחיל.",
-		"post_rejected":             "הפוסט שלך נדחה: %s",
-	},
-	// Add more languages here
+// Locale files are JSON objects of key -> message, one file per language,
+// named <lang>.json. The built-in ones are embedded; a directory given to
+// Load can add languages or override single messages without a rebuild.
+//
+//go:embed locales/*.json
+var builtinLocales embed.FS
+
+var (
+	mu         sync.RWMutex
+	messages   map[string]map[string]string
+	localesDir string
+)
+
+func init() {
+	if err := Load(""); err != nil {
+		panic(fmt.Sprintf("i18n: embedded locales are broken: %v", err))
+	}
 }
 
-func T(lang, key string, args ...interface{}) string {
-	if m, ok := Messages[lang]; ok {
-		if msg, ok := m[key]; ok {
-			if len(args) > 0 {
-				return fmt.Sprintf(msg, args...)
-			}
-			return msg
+// Load reads the embedded locales, then the *.json files in dir on top of
+// them. An empty dir loads only the embedded locales. The previous catalogs
+// stay in use if anything fails to parse.
+func Load(dir string) error {
+	loaded := make(map[string]map[string]string)
+	if err := loadFS(builtinLocales, "locales", loaded); err != nil {
+		return err
+	}
+	if dir != "" {
+		if err := loadFS(os.DirFS(dir), ".", loaded); err != nil {
+			return err
 		}
 	}
-	// fallback to English
-	if msg, ok := Messages["en"][key]; ok {
-		if len(args) > 0 {
-			return fmt.Sprintf(msg, args...)
+	mu.Lock()
+	messages = loaded
+	localesDir = dir
+	mu.Unlock()
+	return nil
+}
+
+// Reload loads the locales again from the directory last passed to Load,
+// e.g. on SIGHUP after a translator edited a file.
+func Reload() error {
+	mu.RLock()
+	dir := localesDir
+	mu.RUnlock()
+	if err := Load(dir); err != nil {
+		return err
+	}
+	for _, problem := range Validate() {
+		log.Printf("[WARNING] i18n: %s", problem)
+	}
+	log.Printf("[INFO] Reloaded locales %v", Locales())
+	return nil
+}
+
+func loadFS(fsys fs.FS, dir string, into map[string]map[string]string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		lang := strings.TrimSuffix(path.Base(file), ".json")
+		if into[lang] == nil {
+			into[lang] = make(map[string]string)
+		}
+		for key, msg := range catalog {
+			into[lang][key] = msg
 		}
+	}
+	return nil
+}
+
+// Locales returns the codes of every available language, sorted.
+func Locales() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return sortedLocales()
+}
+
+// sortedLocales is Locales for callers that already hold mu.
+func sortedLocales() []string {
+	locales := make([]string, 0, len(messages))
+	for lang := range messages {
+		locales = append(locales, lang)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Supported reports whether lang has a message catalog.
+func Supported(lang string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := messages[lang]
+	return ok
+}
+
+// Validate checks every message parses, compares every locale with English
+// and describes each missing key, each message whose named parameters differ
+// from the English one and each plural lacking a category of its language.
+func Validate() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var problems []string
+	en := messages["en"]
+	keys := make([]string, 0, len(en))
+	for key := range en {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, lang := range sortedLocales() {
+		for _, key := range keys {
+			msg, ok := messages[lang][key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing key %q", lang, key))
+				continue
+			}
+			parts, err := parse(msg, false)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: key %q: %v", lang, key, err))
+				continue
+			}
+			if missing := missingPlurals(lang, parts); len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: key %q lacks plural cases %v", lang, key, missing))
+			}
+			if lang == "en" {
+				continue
+			}
+			enParts, err := parse(en[key], false)
+			if err != nil {
+				continue
+			}
+			want, got := params(enParts), params(parts)
+			if strings.Join(want, ",") != strings.Join(got, ",") {
+				problems = append(problems, fmt.Sprintf("%s: key %q has parameters %v, en has %v", lang, key, got, want))
+			}
+		}
+	}
+	return problems
+}
+
+// T returns the message key in lang, falling back to English, with args
+// filled in. A message that does not parse is returned as written.
+func T(lang, key string, args ...Args) string {
+	mu.RLock()
+	msg, ok := messages[lang][key]
+	if !ok {
+		// fallback to English
+		lang = "en"
+		msg, ok = messages[lang][key]
+	}
+	mu.RUnlock()
+	if !ok {
+		return key
+	}
+	parts, err := parse(msg, false)
+	if err != nil {
+		log.Printf("[WARNING] i18n: %s: key %q: %v", lang, key, err)
 		return msg
 	}
-	return key
+	merged := Args{}
+	for _, a := range args {
+		for name, value := range a {
+			merged[name] = value
+		}
+	}
+	var b strings.Builder
+	format(&b, lang, parts, merged, "")
+	return b.String()
 }
@@ -0,0 +1,160 @@
+package i18n
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLocalesComplete fails for every key a locale lacks compared with
+// English, for every message whose named parameters don't match and for
+// every plural lacking a category its language needs.
+func TestLocalesComplete(t *testing.T) {
+	if err := Load(""); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, problem := range Validate() {
+		t.Error(problem)
+	}
+}
+
+func TestValidateReportsProblems(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "xx.json"), []byte(`{"welcome": "Hi", "preview": "{title} {price}", "photo_received": "{count, plural, one {#} other {#}"}`), 0o644)
+	if err := Load(dir); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer Load("")
+	var missing, mismatched, broken bool
+	for _, problem := range Validate() {
+		switch problem {
+		case `xx: missing key "start"`:
+			missing = true
+		case `xx: key "preview" has parameters [price title], en has [description location photos price title]`:
+			mismatched = true
+		case `xx: key "photo_received": unclosed { at offset 0`:
+			broken = true
+		}
+	}
+	if !missing || !mismatched || !broken {
+		t.Errorf("expected missing key, parameter mismatch and parse error, got %v", Validate())
+	}
+}
+
+func TestLoadOverridesAndReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "en.json")
+	os.WriteFile(file, []byte(`{"welcome": "Howdy!"}`), 0o644)
+	if err := Load(dir); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer Load("")
+	if got := T("en", "welcome"); got != "Howdy!" {
+		t.Errorf("expected override, got %q", got)
+	}
+	if got := T("en", "start"); got != "Send /start to begin creating a sale post." {
+		t.Errorf("expected embedded message for keys not overridden, got %q", got)
+	}
+
+	os.WriteFile(file, []byte(`{"welcome": "Hello again!"}`), 0o644)
+	if err := Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := T("en", "welcome"); got != "Hello again!" {
+		t.Errorf("expected reloaded message, got %q", got)
+	}
+
+	// A broken file keeps the previous catalogs
+	os.WriteFile(file, []byte(`{not json`), 0o644)
+	if err := Reload(); err == nil {
+		t.Errorf("expected error for broken locale file")
+	}
+	if got := T("en", "welcome"); got != "Hello again!" {
+		t.Errorf("expected previous catalogs after failed reload, got %q", got)
+	}
+}
+
+func TestFallbackToEnglish(t *testing.T) {
+	if got := T("xx", "start"); got != "Send /start to begin creating a sale post." {
+		t.Errorf("expected English fallback, got %q", got)
+	}
+	if got := T("en", "no_such_key"); got != "no_such_key" {
+		t.Errorf("expected key for unknown message, got %q", got)
+	}
+}
+
+func TestPluralAndSelect(t *testing.T) {
+	const msg = "{n, plural, =0 {no photos} one {# photo} few {# photos (few)} two {# photos (two)} other {# photos}}"
+	parts, err := parse(msg, false)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	cases := []struct {
+		lang string
+		n    int
+		want string
+	}{
+		{"en", 0, "no photos"},
+		{"en", 1, "1 photo"},
+		{"en", 2, "2 photos"},
+		{"cz", 3, "3 photos (few)"},
+		{"cz", 5, "5 photos"},
+		{"he", 2, "\u20662\u2069 photos (two)"},
+		{"he", 3, "\u20663\u2069 photos"},
+	}
+	for _, c := range cases {
+		var b strings.Builder
+		format(&b, c.lang, parts, Args{"n": c.n}, "")
+		if b.String() != c.want {
+			t.Errorf("%s n=%d: got %q, want %q", c.lang, c.n, b.String(), c.want)
+		}
+	}
+
+	parts, err = parse("{gender, select, female {She} other {They}} sold {count, plural, one {# item} other {# items}} for {price}", false)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var b strings.Builder
+	format(&b, "en", parts, Args{"gender": "female", "count": 2, "price": "10 CZK"}, "")
+	if want := "She sold 2 items for 10 CZK"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	if got := params(parts); strings.Join(got, ",") != "count,gender,price" {
+		t.Errorf("unexpected params %v", got)
+	}
+	if missing := missingPlurals("cz", parts); len(missing) != 1 || missing[0] != "{count} few" {
+		t.Errorf("expected missing few case for Czech, got %v", missing)
+	}
+
+	for _, bad := range []string{"{n, plural, one {#}}", "{n, choice, other {x}}", "{}", "a } b"} {
+		if _, err := parse(bad, false); err == nil {
+			t.Errorf("expected parse error for %q", bad)
+		}
+	}
+}
+
+func TestNamedParameters(t *testing.T) {
+	if got := T("cz", "photo_received", Args{"count": 3}); got != "Přijaty 3 fotografie. Pošlete další nebo napište 'done'." {
+		t.Errorf("unexpected Czech plural: %q", got)
+	}
+	if got := T("en", "post_rejected", Args{"reason": "blurry"}); got != "Your post was rejected: blurry" {
+		t.Errorf("unexpected message: %q", got)
+	}
+	// A missing parameter stays visible instead of vanishing
+	if got := T("en", "post_rejected"); got != "Your post was rejected: {reason}" {
+		t.Errorf("unexpected message without args: %q", got)
+	}
+}
+
+func TestRTLIsolates(t *testing.T) {
+	if got := T("he", "post_rejected", Args{"reason": "blurry"}); got != "הפוסט שלך נדחה: \u2068blurry\u2069" {
+		t.Errorf("expected first-strong isolate around the reason, got %q", got)
+	}
+	if got := T("he", "photo_received", Args{"count": 3}); !strings.HasPrefix(got, "\u20663\u2069 תמונות") {
+		t.Errorf("expected left-to-right isolate around the count, got %q", got)
+	}
+	if got := T("en", "post_rejected", Args{"reason": "blurry"}); got != "Your post was rejected: blurry" {
+		t.Errorf("expected no isolates in a left-to-right language, got %q", got)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"gosalebot/bot"
@@ -22,67 +25,164 @@ var (
 	ApprovedGroupID   int64
 )
 
-func startExpirationWorker(db *sql.DB, interval time.Duration) {
+// defaultUpdateWorkers is the number of goroutines handling updates when
+// UPDATE_WORKERS is not set.
+const defaultUpdateWorkers = 8
+
+// startExpirationWorker applies the expiry policy to overdue pending posts
+// and takes down approved listings at the end of their lifetime. It re-reads
+// EXPIRY_POLL_SECONDS before every sleep, so the interval can be changed at
+// runtime. now is the worker's clock.
+func startExpirationWorker(db *sql.DB, sender bot.Sender, now func() time.Time, moderationGroupID, approvedGroupID int64) {
 	go func() {
 		for {
-			rows, err := db.Query(`SELECT id, user_id, title FROM posts WHERE status = 'pending' AND expires_at < datetime('now')`)
-			if err == nil {
-				for rows.Next() {
-					var id, userID int64
-					var title string
-					if err := rows.Scan(&id, &userID, &title); err == nil {
-						log.Printf("Post expired: id=%d, user_id=%d, title=%s", id, userID, title)
-						// Optionally, notify admin or update status
-					}
-				}
-				rows.Close()
+			if _, err := bot.ExpirePosts(db, sender, now(), moderationGroupID, approvedGroupID); err != nil {
+				log.Printf("[ERROR] Expiration worker: %v", err)
+			}
+			if _, err := bot.ExpireListings(db, sender, now()); err != nil {
+				log.Printf("[ERROR] Expiration worker: %v", err)
+			}
+			time.Sleep(gosaledb.PollInterval(db))
+		}
+	}()
+}
+
+// watchLocaleReload reloads the translations on SIGHUP, so edited locale
+// files take effect without a restart.
+func watchLocaleReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := i18n.Reload(); err != nil {
+				log.Printf("[ERROR] Failed to reload locales, keeping the old ones: %v", err)
 			}
-			time.Sleep(interval)
 		}
 	}()
 }
 
-func handleUpdate(db *sql.DB, botAPI *tgbotapi.BotAPI, update tgbotapi.Update, moderationGroupID, approvedGroupID int64) {
+// messagePhotos returns the picture a message carries, if any. Telegram sends
+// a photo in several resolutions; only the largest is kept. Images sent as
+// files (documents with an image MIME type) are accepted as well.
+func messagePhotos(msg *tgbotapi.Message) []fsm.Photo {
+	if len(msg.Photo) > 0 {
+		largest := msg.Photo[0]
+		for _, size := range msg.Photo[1:] {
+			if size.Width*size.Height >= largest.Width*largest.Height {
+				largest = size
+			}
+		}
+		return []fsm.Photo{{
+			FileID:       largest.FileID,
+			FileUniqueID: largest.FileUniqueID,
+			Width:        largest.Width,
+			Height:       largest.Height,
+			FileSize:     int64(largest.FileSize),
+		}}
+	}
+	if doc := msg.Document; doc != nil && strings.HasPrefix(doc.MimeType, "image/") {
+		return []fsm.Photo{{
+			FileID:       doc.FileID,
+			FileUniqueID: doc.FileUniqueID,
+			FileSize:     doc.FileSize,
+			Document:     true,
+		}}
+	}
+	return nil
+}
+
+func handleUpdate(db *sql.DB, botAPI bot.Sender, albums *albumAcks, update tgbotapi.Update, moderationGroupID, approvedGroupID int64) {
 	if update.CallbackQuery != nil {
 		data := update.CallbackQuery.Data
 		userID := update.CallbackQuery.From.ID
 		chatID := update.CallbackQuery.Message.Chat.ID
 		messageID := update.CallbackQuery.Message.MessageID
-		lang := os.Getenv("LANG")
-		if lang == "" {
-			lang = "en"
+		lang := bot.UserLang(db, userID, update.CallbackQuery.From.LanguageCode)
+		if resp, ok := bot.HandleLanguageCallback(db, userID, data); ok {
+			if resp != "" {
+				botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, resp))
+			}
+			return
 		}
-		// Only handle confirm/cancel for user preview here
-		if data == "confirm" || data == "cancel" {
+		// Confirm/cancel/edit answer the preview; the preview message is replaced
+		// by the outcome or by the prompt for the field being edited
+		if data == "confirm" || data == "cancel" || strings.HasPrefix(data, "edit:") {
+			session, ok := fsm.Get(userID)
+			if !ok || session.State != fsm.StatePreview {
+				return
+			}
 			resp := bot.HandleMessageWithDB(db, userID, data, botAPI, chatID, messageID, nil, moderationGroupID, lang)
 			edit := tgbotapi.NewEditMessageText(chatID, messageID, resp)
+			edit.ReplyMarkup = bot.SessionKeyboard(session, lang)
 			botAPI.Send(edit)
 			return
 		} else if data == "done" {
-			if session, ok := fsm.Sessions[userID]; ok && session.State == fsm.StatePhotos {
+			if session, ok := fsm.Get(userID); ok && session.State == fsm.StatePhotos {
+				albums.Discard(chatID)
 				response := bot.HandleMessageWithDB(db, userID, "done", botAPI, chatID, messageID, nil, moderationGroupID, lang)
-				edit := tgbotapi.NewEditMessageText(chatID, messageID, response)
-				botAPI.Send(edit)
+				// The preview album is sent below the "Done" message, so post the
+				// preview text after it instead of editing the old message.
+				msg := tgbotapi.NewMessage(chatID, response)
+				msg.ReplyMarkup = bot.SessionKeyboard(session, lang)
+				botAPI.Send(msg)
 			}
 			return
-		} else if data == "approve" {
-			err := bot.ApprovePost(db, botAPI, update.CallbackQuery.Message, approvedGroupID)
-			if err != nil {
-				log.Printf("[ERROR] Failed to approve post: %v", err)
-				edit := tgbotapi.NewEditMessageText(chatID, messageID, "❌ Failed to approve post.")
-				botAPI.Send(edit)
+		}
+		if action, postID, ok := bot.ParseListingCallback(data); ok {
+			text, markup := bot.HandleListingAction(db, botAPI, userID, action, postID, moderationGroupID, approvedGroupID, lang)
+			edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+			edit.ReplyMarkup = markup
+			botAPI.Send(edit)
+			return
+		}
+		if action, editID, ok := bot.ParseEditCallback(data); ok {
+			groupLang := bot.DefaultLang()
+			// A double tap, or a request another moderator or a newer request
+			// already settled, must not claim an outcome it didn't have
+			if action == "approve_edit" {
+				if err := bot.ApproveEdit(db, botAPI, editID); errors.Is(err, bot.ErrEditStale) {
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_edit_stale")))
+				} else if errors.Is(err, bot.ErrEditNotPending) {
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_edit_decided")))
+				} else if err != nil {
+					log.Printf("[ERROR] Failed to approve edit %d: %v", editID, err)
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_approve_failed")))
+				} else {
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_edit_approved")))
+				}
 			} else {
-				edit := tgbotapi.NewEditMessageText(chatID, messageID, "✅ Approved and forwarded.")
-				botAPI.Send(edit)
+				if err := bot.RejectEdit(db, botAPI, editID); errors.Is(err, bot.ErrEditNotPending) {
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_edit_decided")))
+				} else if err != nil {
+					log.Printf("[ERROR] Failed to reject edit %d: %v", editID, err)
+				} else {
+					botAPI.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_rejected")))
+				}
 			}
 			return
-		} else if data == "reject" {
-			err := bot.RejectPost(db, botAPI, update.CallbackQuery.Message, "Rejected by admin")
-			if err != nil {
-				log.Printf("[ERROR] Failed to reject post: %v", err)
+		}
+		if action, postID, ok := bot.ParseModerationCallback(data); ok {
+			// The moderation message is shared by the group, so it stays in the
+			// group's language rather than the moderator's
+			groupLang := bot.DefaultLang()
+			if action == "approve" {
+				err := bot.ApprovePost(db, botAPI, postID, approvedGroupID)
+				if err != nil {
+					log.Printf("[ERROR] Failed to approve post %d: %v", postID, err)
+					edit := tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_approve_failed"))
+					botAPI.Send(edit)
+				} else {
+					edit := tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_approved"))
+					botAPI.Send(edit)
+				}
+			} else {
+				err := bot.RejectPost(db, botAPI, postID, "")
+				if err != nil {
+					log.Printf("[ERROR] Failed to reject post %d: %v", postID, err)
+				}
+				edit := tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(groupLang, "moderation_rejected"))
+				botAPI.Send(edit)
 			}
-			edit := tgbotapi.NewEditMessageText(chatID, messageID, "❌ Rejected.")
-			botAPI.Send(edit)
 			return
 		}
 	}
@@ -90,31 +190,41 @@ func handleUpdate(db *sql.DB, botAPI *tgbotapi.BotAPI, update tgbotapi.Update, m
 	if update.Message != nil && update.Message.From != nil {
 		userID := update.Message.From.ID
 		text := update.Message.Text
-		var photoFileIDs []string
-		if update.Message.Photo != nil && len(update.Message.Photo) > 0 {
-			for _, photo := range update.Message.Photo {
-				photoFileIDs = append(photoFileIDs, photo.FileID)
-			}
-		}
+		photos := messagePhotos(update.Message)
 		if update.Message.Chat.ID == moderationGroupID {
-			if update.Message.ReplyToMessage != nil {
-				err := bot.RejectPost(db, botAPI, update.Message.ReplyToMessage, update.Message.Text)
+			// Moderators act by replying to the moderation message: "/approve" or ✅
+			// approves the post, any other reply rejects it with the reply as reason.
+			if reply := update.Message.ReplyToMessage; reply != nil {
+				postID, err := gosaledb.FindPostByModerationMessage(db, reply.Chat.ID, reply.MessageID)
 				if err != nil {
-					log.Printf("[ERROR] Failed to reject post: %v", err)
+					log.Printf("[WARNING] Reply to message %d is not linked to a post: %v", reply.MessageID, err)
+					return
 				}
-				return
-			}
-			if text == "/approve" || text == "✅" {
-				err := bot.ApprovePost(db, botAPI, update.Message, approvedGroupID)
-				if err != nil {
-					log.Printf("[ERROR] Failed to approve post: %v", err)
+				if text == "/approve" || text == "✅" {
+					err = bot.ApprovePost(db, botAPI, postID, approvedGroupID)
+					if err != nil {
+						log.Printf("[ERROR] Failed to approve post %d: %v", postID, err)
+					}
+				} else {
+					err = bot.RejectPost(db, botAPI, postID, text)
+					if err != nil {
+						log.Printf("[ERROR] Failed to reject post %d: %v", postID, err)
+					}
 				}
 				return
 			}
 		}
-		lang := os.Getenv("LANG")
-		if lang == "" {
-			lang = "en"
+		lang := bot.UserLang(db, userID, update.Message.From.LanguageCode)
+		if text == "/language" {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, i18n.T(lang, "choose_language"))
+			msg.ReplyMarkup = bot.LanguageKeyboard()
+			msg.ReplyToMessageID = update.Message.MessageID
+			botAPI.Send(msg)
+			return
+		}
+		if text == "/mylistings" && update.Message.Chat.IsPrivate() {
+			bot.SendMyListings(db, botAPI, userID, update.Message.Chat.ID, lang)
+			return
 		}
 		if bot.IsAdmin(userID) && (strings.HasPrefix(text, "/config") || text == "/pending") {
 			response := bot.HandleAdminCommand(db, userID, text)
@@ -123,63 +233,32 @@ func handleUpdate(db *sql.DB, botAPI *tgbotapi.BotAPI, update tgbotapi.Update, m
 			botAPI.Send(msg)
 			return
 		}
-		var session *fsm.UserSession
-		if s, ok := fsm.Sessions[userID]; ok {
-			session = s
-		}
 		username := ""
 		if update.Message.From != nil {
 			username = update.Message.From.UserName
 		}
-		resp := bot.HandleMessageWithDB(db, userID, text, botAPI, update.Message.Chat.ID, update.Message.MessageID, photoFileIDs, moderationGroupID, lang, username)
-		if text == "done" && session != nil && resp == i18n.T(lang, "preview", session.PostData["title"], session.PostData["description"], session.PostData["price"], session.PostData["location"], len(session.PostData["photos"].([]string))) {
-			// User just finished photo upload, now in preview state: show preview with inline buttons
-			if session.State == fsm.StatePreview {
-				var numPhotos int
-				if photos, ok := session.PostData["photos"].([]string); ok {
-					numPhotos = len(photos)
-				} else if photos, ok := session.PostData["photos"].([]interface{}); ok {
-					numPhotos = len(photos)
-				} else {
-					numPhotos = 0
-				}
-				preview := i18n.T(lang, "preview",
-					session.PostData["title"], session.PostData["description"],
-					session.PostData["price"], session.PostData["location"], numPhotos,
-				)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, preview)
-				msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-					tgbotapi.NewInlineKeyboardRow(
-						tgbotapi.NewInlineKeyboardButtonData("✅ Confirm", "confirm"),
-						tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", "cancel"),
-					),
-				)
-				msg.ReplyToMessageID = update.Message.MessageID
-				botAPI.Send(msg)
-				return
-			}
-		}
-		showDoneButton := false
-		if session, ok := fsm.Sessions[userID]; ok && session.State == fsm.StatePhotos {
-			showDoneButton = true
-		}
-		if showDoneButton {
-			btn := tgbotapi.NewInlineKeyboardButtonData("Done", "done")
-			markup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(btn))
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, resp)
-			msg.ReplyMarkup = markup
-			msg.ReplyToMessageID = update.Message.MessageID
-			botAPI.Send(msg)
+		resp := bot.HandleMessageWithDB(db, userID, text, botAPI, update.Message.Chat.ID, update.Message.MessageID, photos, moderationGroupID, lang, username)
+		if resp == "" {
 			return
 		}
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, resp)
 		msg.ReplyToMessageID = update.Message.MessageID
-		if resp != "" {
-			_, err := botAPI.Send(msg)
-			if err != nil {
-				log.Printf("Error sending message: %v", err)
+		if session, ok := fsm.Get(userID); ok {
+			// Attach the buttons that belong to the state the user is now in
+			if markup := bot.SessionKeyboard(session, lang); markup != nil {
+				msg.ReplyMarkup = *markup
 			}
 		}
+		// The photos of an album arrive as separate updates; answer them once
+		if mediaGroupID := update.Message.MediaGroupID; mediaGroupID != "" && len(photos) > 0 {
+			albums.Add(mediaGroupID, msg)
+			return
+		}
+		albums.Discard(update.Message.Chat.ID)
+		_, err := botAPI.Send(msg)
+		if err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
 	}
 }
 
@@ -189,6 +268,16 @@ func main() {
 		log.Fatal("TELEGRAM_TOKEN environment variable is required")
 	}
 
+	if dir := os.Getenv("LOCALES_DIR"); dir != "" {
+		if err := i18n.Load(dir); err != nil {
+			log.Fatalf("Failed to load locales from %s: %v", dir, err)
+		}
+	}
+	for _, problem := range i18n.Validate() {
+		log.Printf("[WARNING] i18n: %s", problem)
+	}
+	watchLocaleReload()
+
 	modGroup := os.Getenv("MODERATION_GROUP_ID")
 	approvedGroup := os.Getenv("APPROVED_GROUP_ID")
 	if modGroup == "" || approvedGroup == "" {
@@ -204,49 +293,19 @@ func main() {
 		log.Fatalf("Invalid APPROVED_GROUP_ID: %v", err)
 	}
 
-	db, err := sql.Open("sqlite3", "./data/gosalebot.db")
+	// Updates are handled concurrently, so wait on locks instead of failing
+	// with SQLITE_BUSY, and use WAL so readers don't block the writer.
+	db, err := sql.Open("sqlite3", "./data/gosalebot.db?_busy_timeout=5000&_journal_mode=WAL")
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 	defer db.Close()
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS posts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		chat_id INTEGER NOT NULL,
-		message_id INTEGER NOT NULL,
-		status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected')),
-		title TEXT,
-		description TEXT,
-		price TEXT,
-		location TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME
-	)`)
-	if err != nil {
-		log.Fatalf("Failed to create posts table: %v", err)
+	if err := gosaledb.Migrate(db); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
 	}
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS photos (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
-		file_id TEXT NOT NULL
-	)`)
-	if err != nil {
-		log.Fatalf("Failed to create photos table: %v", err)
-	}
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS config (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	)`)
-	if err != nil {
-		log.Fatalf("Failed to create config table: %v", err)
-	}
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY,
-		username TEXT
-	)`)
-	if err != nil {
-		log.Fatalf("Failed to create users table: %v", err)
+	if err := fsm.UseStore(gosaledb.NewSessionStore(db)); err != nil {
+		log.Fatalf("Failed to load sessions: %v", err)
 	}
 
 	// Set config values from env if not present
@@ -256,9 +315,38 @@ func main() {
 	if err := gosaledb.SetConfig(db, "APPROVED_GROUP_ID", approvedGroup); err != nil {
 		log.Printf("Failed to set APPROVED_GROUP_ID in config: %v", err)
 	}
-	if err := gosaledb.SetConfig(db, "TIMEOUT_MINUTES", "1440"); err != nil { // default 24h
+	// Timeouts are only defaulted, so values changed later with /config survive a restart
+	timeoutDefault := os.Getenv("TIMEOUT_MINUTES")
+	if timeoutDefault == "" {
+		timeoutDefault = strconv.Itoa(gosaledb.DefaultTimeoutMinutes) // default 24h
+	}
+	if err := gosaledb.SetConfigDefault(db, "TIMEOUT_MINUTES", timeoutDefault); err != nil {
 		log.Printf("Failed to set TIMEOUT_MINUTES in config: %v", err)
 	}
+	if err := gosaledb.SetConfigDefault(db, "EXPIRY_POLL_SECONDS", strconv.Itoa(gosaledb.DefaultPollSeconds)); err != nil {
+		log.Printf("Failed to set EXPIRY_POLL_SECONDS in config: %v", err)
+	}
+	if err := gosaledb.SetConfigDefault(db, "MAX_PHOTOS", strconv.Itoa(gosaledb.DefaultMaxPhotos)); err != nil {
+		log.Printf("Failed to set MAX_PHOTOS in config: %v", err)
+	}
+	if err := gosaledb.SetConfigDefault(db, "LISTING_LIFETIME_DAYS", strconv.Itoa(gosaledb.DefaultListingLifetimeDays)); err != nil {
+		log.Printf("Failed to set LISTING_LIFETIME_DAYS in config: %v", err)
+	}
+	if err := gosaledb.SetConfigDefault(db, "LISTING_REMINDER_DAYS", strconv.Itoa(gosaledb.DefaultListingReminderDays)); err != nil {
+		log.Printf("Failed to set LISTING_REMINDER_DAYS in config: %v", err)
+	}
+	if err := gosaledb.SetConfigDefault(db, "DEFAULT_CURRENCY", bot.DefaultCurrency); err != nil {
+		log.Printf("Failed to set DEFAULT_CURRENCY in config: %v", err)
+	}
+	for field, limit := range gosaledb.DefaultLengthLimits {
+		minKey, maxKey := gosaledb.LengthKeys(field)
+		if err := gosaledb.SetConfigDefault(db, minKey, strconv.Itoa(limit.Min)); err != nil {
+			log.Printf("Failed to set %s in config: %v", minKey, err)
+		}
+		if err := gosaledb.SetConfigDefault(db, maxKey, strconv.Itoa(limit.Max)); err != nil {
+			log.Printf("Failed to set %s in config: %v", maxKey, err)
+		}
+	}
 
 	// Read config values from DB
 	modGroup, err = gosaledb.GetConfig(db, "MODERATION_GROUP_ID")
@@ -269,15 +357,8 @@ func main() {
 	if err != nil {
 		log.Fatal("APPROVED_GROUP_ID not set in config table")
 	}
-	timeoutStr, err := gosaledb.GetConfig(db, "TIMEOUT_MINUTES")
-	if err != nil {
-		log.Fatal("TIMEOUT_MINUTES not set in config table")
-	}
-	timeoutMinutes, err := strconv.Atoi(timeoutStr)
-	if err != nil {
-		log.Fatalf("Invalid TIMEOUT_MINUTES: %v", err)
-	}
-	log.Printf("Config loaded: MODERATION_GROUP_ID=%s, APPROVED_GROUP_ID=%s, TIMEOUT_MINUTES=%d", modGroup, approvedGroup, timeoutMinutes)
+	log.Printf("Config loaded: MODERATION_GROUP_ID=%s, APPROVED_GROUP_ID=%s, TIMEOUT=%s, EXPIRY_POLL=%s",
+		modGroup, approvedGroup, gosaledb.PendingTimeout(db), gosaledb.PollInterval(db))
 
 	botAPI, err := tgbotapi.NewBotAPI(telegramToken)
 	if err != nil {
@@ -289,12 +370,28 @@ func main() {
 	u.Timeout = 60
 	updates := botAPI.GetUpdatesChan(u)
 
-	startExpirationWorker(db, time.Duration(timeoutMinutes)*time.Minute)
-
 	bot.LoadAdminsFromEnv()
 
+	startExpirationWorker(db, botAPI, time.Now, ModerationGroupID, ApprovedGroupID)
+
+	workers := defaultUpdateWorkers
+	if workersStr := os.Getenv("UPDATE_WORKERS"); workersStr != "" {
+		workers, err = strconv.Atoi(workersStr)
+		if err != nil || workers < 1 {
+			log.Fatalf("Invalid UPDATE_WORKERS: %q", workersStr)
+		}
+	}
+	albums := newAlbumAcks(botAPI, albumDebounce)
+	dispatch := newDispatcher(workers, 100,
+		func(update tgbotapi.Update) int64 { return updateKey(update, ModerationGroupID) },
+		func(update tgbotapi.Update) {
+			handleUpdate(db, botAPI, albums, update, ModerationGroupID, ApprovedGroupID)
+		},
+	)
+	defer dispatch.Close()
+
+	log.Printf("GoSaleBot started with %d update workers. Ready to accept Telegram updates.", workers)
 	for update := range updates {
-		handleUpdate(db, botAPI, update, ModerationGroupID, ApprovedGroupID)
+		dispatch.Dispatch(update)
 	}
-	log.Println("GoSaleBot started. Ready to accept Telegram updates.")
 }
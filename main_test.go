@@ -2,13 +2,28 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"gosalebot/bot"
+	"gosalebot/bot/bottest"
 	"gosalebot/db"
 	"gosalebot/fsm"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	tgbotapi "github.com/matterbridge/telegram-bot-api/v6"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -37,26 +52,8 @@ func TestGroupIDEnvParsing(t *testing.T) {
 }
 
 func TestSavePostToDB(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Fatalf("Failed to open in-memory DB: %v", err)
-	}
-	defer db.Close()
-
-	_, err = db.Exec(`CREATE TABLE posts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected')),
-		title TEXT,
-		description TEXT,
-		price TEXT,
-		location TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME
-	)`)
-	if err != nil {
-		t.Fatalf("Failed to create posts table: %v", err)
-	}
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
 
 	postData := map[string]interface{}{
 		"title":       "Test Title",
@@ -64,12 +61,12 @@ func TestSavePostToDB(t *testing.T) {
 		"price":       "$10",
 		"location":    "Test City",
 	}
-	err = savePostToDB(db, 42, postData)
+	_, err := db.SavePostToDB(dbConn, 42, postData)
 	if err != nil {
-		t.Fatalf("savePostToDB failed: %v", err)
+		t.Fatalf("SavePostToDB failed: %v", err)
 	}
 
-	row := db.QueryRow("SELECT user_id, status, title, description, price, location FROM posts WHERE user_id = ?", 42)
+	row := dbConn.QueryRow("SELECT user_id, status, title, description, price, location FROM posts WHERE user_id = ?", 42)
 	var userID int64
 	var status, title, description, price, location string
 	err = row.Scan(&userID, &status, &title, &description, &price, &location)
@@ -86,34 +83,10 @@ func setupTestDB(t *testing.T) *sql.DB {
 	if err != nil {
 		t.Fatalf("Failed to open in-memory DB: %v", err)
 	}
-	_, err = dbConn.Exec(`CREATE TABLE posts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected')),
-		title TEXT,
-		description TEXT,
-		price TEXT,
-		location TEXT,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME
-	)`)
-	if err != nil {
-		t.Fatalf("Failed to create posts table: %v", err)
-	}
-	_, err = dbConn.Exec(`CREATE TABLE photos (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
-		file_id TEXT NOT NULL
-	)`)
-	if err != nil {
-		t.Fatalf("Failed to create photos table: %v", err)
-	}
-	_, err = dbConn.Exec(`CREATE TABLE config (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	)`)
-	if err != nil {
-		t.Fatalf("Failed to create config table: %v", err)
+	// Every connection to :memory: is a separate database, so keep just one
+	dbConn.SetMaxOpenConns(1)
+	if err := db.Migrate(dbConn); err != nil {
+		t.Fatalf("Failed to migrate DB: %v", err)
 	}
 	return dbConn
 }
@@ -131,9 +104,129 @@ func TestConfigHelpers(t *testing.T) {
 	}
 }
 
+func TestModerationMessageLink(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	// Two pending posts with the same title must stay distinguishable
+	postData := map[string]interface{}{"title": "Bike", "description": "Red", "price": "10", "location": "Brno"}
+	firstID, err := db.SavePostToDB(dbConn, 1, postData)
+	if err != nil {
+		t.Fatalf("SavePostToDB failed: %v", err)
+	}
+	secondID, err := db.SavePostToDB(dbConn, 2, postData)
+	if err != nil {
+		t.Fatalf("SavePostToDB failed: %v", err)
+	}
+	if err := db.SetModerationMessage(dbConn, firstID, -1001, 10); err != nil {
+		t.Fatalf("SetModerationMessage failed: %v", err)
+	}
+	if err := db.SetModerationMessage(dbConn, secondID, -1001, 11); err != nil {
+		t.Fatalf("SetModerationMessage failed: %v", err)
+	}
+	got, err := db.FindPostByModerationMessage(dbConn, -1001, 10)
+	if err != nil || got != firstID {
+		t.Errorf("expected post %d for message 10, got %d (err=%v)", firstID, got, err)
+	}
+	got, err = db.FindPostByModerationMessage(dbConn, -1001, 11)
+	if err != nil || got != secondID {
+		t.Errorf("expected post %d for message 11, got %d (err=%v)", secondID, got, err)
+	}
+	if _, err := db.FindPostByModerationMessage(dbConn, -1001, 12); err == nil {
+		t.Errorf("expected error for unlinked message")
+	}
+}
+
+func TestParseModerationCallback(t *testing.T) {
+	cases := []struct {
+		data   string
+		action string
+		postID int64
+		ok     bool
+	}{
+		{"approve:42", "approve", 42, true},
+		{"reject:7", "reject", 7, true},
+		{"approve", "", 0, false},
+		{"confirm:1", "", 0, false},
+		{"reject:abc", "", 0, false},
+	}
+	for _, c := range cases {
+		action, postID, ok := bot.ParseModerationCallback(c.data)
+		if action != c.action || postID != c.postID || ok != c.ok {
+			t.Errorf("ParseModerationCallback(%q) = %q, %d, %v; want %q, %d, %v", c.data, action, postID, ok, c.action, c.postID, c.ok)
+		}
+	}
+}
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	store := db.NewSessionStore(dbConn)
+	session := &fsm.UserSession{UserID: 77, State: fsm.StatePhotos, PostData: map[string]interface{}{
+		"title":   "Lamp",
+		"price":   "5",
+		"photos":  []fsm.Photo{{FileID: "file_a", FileUniqueID: "ua", Width: 1280, Height: 960}, {FileID: "file_b"}},
+		"chat_id": int64(77),
+	}}
+	if err := store.SaveSession(session); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	loaded, err := store.LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions failed: %v", err)
+	}
+	got, ok := loaded[77]
+	if !ok {
+		t.Fatalf("expected session for user 77, got %v", loaded)
+	}
+	if got.State != fsm.StatePhotos || got.PostData["title"] != "Lamp" || got.PostData["price"] != "5" {
+		t.Errorf("unexpected session after reload: %+v", got)
+	}
+	if photos, ok := got.PostData["photos"].([]fsm.Photo); !ok || len(photos) != 2 || photos[0].Width != 1280 || photos[1].FileID != "file_b" {
+		t.Errorf("expected photos to reload as []fsm.Photo, got %#v", got.PostData["photos"])
+	}
+	if chatID, ok := got.PostData["chat_id"].(int64); !ok || chatID != 77 {
+		t.Errorf("expected chat_id to reload as int64, got %#v", got.PostData["chat_id"])
+	}
+	if err := store.DeleteSession(77); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	loaded, _ = store.LoadSessions()
+	if _, ok := loaded[77]; ok {
+		t.Errorf("expected session to be deleted")
+	}
+}
+
+func TestSessionPersistedAcrossRestart(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	if err := fsm.UseStore(db.NewSessionStore(dbConn)); err != nil {
+		t.Fatalf("UseStore failed: %v", err)
+	}
+	defer fsm.UseStore(nil)
+	userID := int64(778)
+	fsm.Delete(userID)
+	bot.HandleMessageWithDB(dbConn, userID, "/start", nil, userID, 1, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, userID, "Chair", nil, userID, 2, nil, -1001, "en")
+
+	// Simulate a restart: drop the in-memory session and reload from the DB
+	fsm.Delete(userID)
+	if err := fsm.UseStore(db.NewSessionStore(dbConn)); err != nil {
+		t.Fatalf("UseStore failed: %v", err)
+	}
+	session, ok := fsm.Get(userID)
+	if !ok {
+		t.Fatalf("expected session to be restored")
+	}
+	if session.State != fsm.StateDescription || session.PostData["title"] != "Chair" {
+		t.Errorf("unexpected restored session: %+v", session)
+	}
+}
+
 func TestAdminCommandConfig(t *testing.T) {
 	dbConn := setupTestDB(t)
 	defer dbConn.Close()
+	t.Setenv("ADMINS", "123456789")
+	bot.LoadAdminsFromEnv()
 	resp := bot.HandleAdminCommand(dbConn, 123456789, "/config FOO BAR")
 	if resp != "Config updated: FOO = BAR" {
 		t.Errorf("unexpected response: %s", resp)
@@ -147,8 +240,10 @@ func TestAdminCommandConfig(t *testing.T) {
 func TestAdminCommandPending(t *testing.T) {
 	dbConn := setupTestDB(t)
 	defer dbConn.Close()
+	t.Setenv("ADMINS", "123456789")
+	bot.LoadAdminsFromEnv()
 	// Insert a pending post
-	_, err := dbConn.Exec(`INSERT INTO posts (user_id, status, title, description, price, location, created_at, expires_at) VALUES (1, 'pending', 'Test', 'Desc', '10', 'Loc', datetime('now'), datetime('now', '+24 hours'))`)
+	_, err := dbConn.Exec(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at) VALUES (1, 1, 1, 'pending', 'Test', 'Desc', '10', 'Loc', datetime('now'), datetime('now', '+24 hours'))`)
 	if err != nil {
 		t.Fatalf("Failed to insert post: %v", err)
 	}
@@ -179,9 +274,19 @@ func TestEnvParsingAndTimeout(t *testing.T) {
 	}
 }
 
+// mustSession returns the in-memory FSM session for userID or fails the test.
+func mustSession(t *testing.T, userID int64) *fsm.UserSession {
+	t.Helper()
+	session, ok := fsm.Get(userID)
+	if !ok {
+		t.Fatalf("no session for user %d", userID)
+	}
+	return session
+}
+
 func TestFSMUserFlow(t *testing.T) {
 	// This test simulates a full user flow through the FSM: title → description → price → location → photos → preview → confirm/cancel
-	// It uses the real FSM and bot logic, with an in-memory DB and a fake bot (nil for tgbotapi.BotAPI, since we don't send real messages)
+	// It uses the real FSM and bot logic, with an in-memory DB and a recording fake bot, since we don't send real messages
 	// We check state transitions and output messages.
 
 	dbConn := setupTestDB(t)
@@ -189,77 +294,2271 @@ func TestFSMUserFlow(t *testing.T) {
 	userID := int64(555)
 	moderationGroupID := int64(-1001)
 	lang := "en"
+	sender := &bottest.Recorder{}
 
 	// Reset FSM session
-	if session, ok := fsm.Sessions[userID]; ok {
-		session.State = fsm.StateIdle
-		session.PostData = make(map[string]interface{})
-	} else {
-		fsm.Sessions[userID] = &fsm.UserSession{UserID: userID, State: fsm.StateIdle, PostData: make(map[string]interface{})}
-	}
+	fsm.Delete(userID)
 
 	// 1. Start
-	resp := bot.HandleMessageWithDB(dbConn, userID, "/start", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StateTitle {
-		t.Fatalf("Expected welcome message and StateTitle, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp := bot.HandleMessageWithDB(dbConn, userID, "/start", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StateTitle {
+		t.Fatalf("Expected welcome message and StateTitle, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 
 	// 2. Title
-	resp = bot.HandleMessageWithDB(dbConn, userID, "My Item", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StateDescription {
-		t.Fatalf("Expected description prompt and StateDescription, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "My Item", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StateDescription {
+		t.Fatalf("Expected description prompt and StateDescription, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 
 	// 3. Description
-	resp = bot.HandleMessageWithDB(dbConn, userID, "A great item", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StatePrice {
-		t.Fatalf("Expected price prompt and StatePrice, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "A great item", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StatePrice {
+		t.Fatalf("Expected price prompt and StatePrice, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 
 	// 4. Price
-	resp = bot.HandleMessageWithDB(dbConn, userID, "$42", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StateLocation {
-		t.Fatalf("Expected location prompt and StateLocation, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "$42", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StateLocation {
+		t.Fatalf("Expected location prompt and StateLocation, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 
 	// 5. Location
-	resp = bot.HandleMessageWithDB(dbConn, userID, "Tel Aviv", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StatePhotos {
-		t.Fatalf("Expected photo prompt and StatePhotos, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "Tel Aviv", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StatePhotos {
+		t.Fatalf("Expected photo prompt and StatePhotos, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 
 	// 6. Add photo
-	photoIDs := []string{"photo_file_id_1"}
-	resp = bot.HandleMessageWithDB(dbConn, userID, "", nil, 0, 0, photoIDs, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StatePhotos {
-		t.Fatalf("Expected photo received message and StatePhotos, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "", sender, 0, 0, testPhotos("photo_file_id_1"), moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StatePhotos {
+		t.Fatalf("Expected photo received message and StatePhotos, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
-	if photos, ok := fsm.Sessions[userID].PostData["photos"].([]string); !ok || len(photos) != 1 {
-		t.Fatalf("Expected 1 photo in session, got: %v", fsm.Sessions[userID].PostData["photos"])
+	if photos, ok := mustSession(t, userID).PostData["photos"].([]fsm.Photo); !ok || len(photos) != 1 {
+		t.Fatalf("Expected 1 photo in session, got: %v", mustSession(t, userID).PostData["photos"])
 	}
 
 	// 7. Done with photos
-	resp = bot.HandleMessageWithDB(dbConn, userID, "done", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StatePreview {
-		t.Fatalf("Expected preview message and StatePreview, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "done", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StatePreview {
+		t.Fatalf("Expected preview message and StatePreview, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 	if want := "Preview:"; resp[:len(want)] != want {
 		t.Errorf("Expected preview message, got: %q", resp)
 	}
 
 	// 8. Confirm
-	resp = bot.HandleMessageWithDB(dbConn, userID, "confirm", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StateIdle {
-		t.Fatalf("Expected post submitted message and StateIdle, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	resp = bot.HandleMessageWithDB(dbConn, userID, "confirm", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StateIdle {
+		t.Fatalf("Expected post submitted message and StateIdle, got: %q, state=%d", resp, mustSession(t, userID).State)
 	}
 	if want := "Post submitted for moderation!"; resp != want {
 		t.Errorf("Expected submission confirmation, got: %q", resp)
 	}
 
 	// 9. Cancel flow (should reset to idle)
-	fsm.Sessions[userID].State = fsm.StatePreview
-	resp = bot.HandleMessageWithDB(dbConn, userID, "cancel", nil, 0, 0, nil, moderationGroupID, lang)
-	if resp == "" || fsm.Sessions[userID].State != fsm.StateIdle {
-		t.Fatalf("Expected post cancelled message and StateIdle, got: %q, state=%d", resp, fsm.Sessions[userID].State)
+	mustSession(t, userID).State = fsm.StatePreview
+	resp = bot.HandleMessageWithDB(dbConn, userID, "cancel", sender, 0, 0, nil, moderationGroupID, lang)
+	if resp == "" || mustSession(t, userID).State != fsm.StateIdle {
+		t.Fatalf("Expected post cancelled message and StateIdle, got: %q, state=%d", resp, mustSession(t, userID).State)
+	}
+}
+
+func TestDispatcherSerializesPerKey(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+	d := newDispatcher(4, 10,
+		func(update tgbotapi.Update) int64 { return update.Message.From.ID },
+		func(update tgbotapi.Update) {
+			// Make later updates faster so reordering would show up
+			time.Sleep(time.Duration(10-update.Message.MessageID) * time.Millisecond)
+			mu.Lock()
+			seen[update.Message.From.ID] = append(seen[update.Message.From.ID], update.Message.MessageID)
+			mu.Unlock()
+		},
+	)
+	for i := 0; i < 10; i++ {
+		for user := int64(1); user <= 3; user++ {
+			d.Dispatch(tgbotapi.Update{Message: &tgbotapi.Message{MessageID: i, From: &tgbotapi.User{ID: user}}})
+		}
+	}
+	d.Close()
+	for user := int64(1); user <= 3; user++ {
+		got := seen[user]
+		if len(got) != 10 {
+			t.Fatalf("user %d: expected 10 updates, got %v", user, got)
+		}
+		for i, id := range got {
+			if id != i {
+				t.Errorf("user %d: updates handled out of order: %v", user, got)
+				break
+			}
+		}
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	modGroup := int64(-1001)
+	private := tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 5}, Chat: &tgbotapi.Chat{ID: 5}}}
+	if got := updateKey(private, modGroup); got != 5 {
+		t.Errorf("private message: expected key 5, got %d", got)
+	}
+	moderation := tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: 6}, Chat: &tgbotapi.Chat{ID: modGroup}}}
+	if got := updateKey(moderation, modGroup); got != modGroup {
+		t.Errorf("moderation message: expected key %d, got %d", modGroup, got)
+	}
+	callback := tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{From: &tgbotapi.User{ID: 7}, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: modGroup}}}}
+	if got := updateKey(callback, modGroup); got != modGroup {
+		t.Errorf("moderation callback: expected key %d, got %d", modGroup, got)
+	}
+}
+
+// TestConcurrentWizards runs many users through the wizard at once; run it
+// with -race to check the session map and store for data races.
+func TestConcurrentWizards(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	if err := fsm.UseStore(db.NewSessionStore(dbConn)); err != nil {
+		t.Fatalf("UseStore failed: %v", err)
+	}
+	defer fsm.UseStore(nil)
+
+	const users = 20
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		userID := int64(10000 + i)
+		fsm.Delete(userID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, text := range []string{"/start", fmt.Sprintf("Item %d", userID), "Desc", "10", "Prague"} {
+				bot.HandleMessageWithDB(dbConn, userID, text, nil, userID, 1, nil, -1001, "en")
+			}
+			bot.HandleMessageWithDB(dbConn, userID, "", nil, userID, 2, testPhotos(fmt.Sprintf("photo-%d", userID)), -1001, "en")
+		}()
+	}
+	wg.Wait()
+
+	loaded, err := db.NewSessionStore(dbConn).LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions failed: %v", err)
+	}
+	for i := 0; i < users; i++ {
+		userID := int64(10000 + i)
+		session := mustSession(t, userID)
+		if session.State != fsm.StatePhotos || session.PostData["title"] != fmt.Sprintf("Item %d", userID) {
+			t.Errorf("user %d: unexpected session %+v", userID, session)
+		}
+		if stored, ok := loaded[userID]; !ok || stored.State != fsm.StatePhotos {
+			t.Errorf("user %d: session not persisted", userID)
+		}
+	}
+}
+
+// testPhotos turns file IDs into photos, deriving each unique ID from the
+// file ID.
+func testPhotos(fileIDs ...string) []fsm.Photo {
+	photos := make([]fsm.Photo, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		photos = append(photos, fsm.Photo{FileID: id, FileUniqueID: "u-" + id, Width: 800, Height: 600})
+	}
+	return photos
+}
+
+// runWizard walks userID through the wizard up to the photo step.
+func runWizard(t *testing.T, dbConn *sql.DB, sender bot.Sender, userID int64, title string, photos ...string) {
+	t.Helper()
+	fsm.Delete(userID)
+	for _, text := range []string{"/start", title, "Desc", "10", "Brno"} {
+		bot.HandleMessageWithDB(dbConn, userID, text, sender, userID, 1, nil, -1001, "en")
+	}
+	if len(photos) > 0 {
+		bot.HandleMessageWithDB(dbConn, userID, "", sender, userID, 2, testPhotos(photos...), -1001, "en")
+	}
+	if state := mustSession(t, userID).State; state != fsm.StatePhotos {
+		t.Fatalf("expected StatePhotos after wizard, got %d", state)
+	}
+}
+
+// submitPost runs the wizard for userID and submits the post for moderation,
+// returning the new post's ID.
+func submitPost(t *testing.T, dbConn *sql.DB, sender *bottest.Recorder, userID int64, title string, photos ...string) int64 {
+	t.Helper()
+	runWizard(t, dbConn, sender, userID, title, photos...)
+	bot.HandleMessageWithDB(dbConn, userID, "done", sender, userID, 3, nil, -1001, "en")
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, userID, "confirm", sender, userID, 4, nil, -1001, "en")
+	var postID int64
+	if err := dbConn.QueryRow("SELECT id FROM posts WHERE user_id = ? ORDER BY id DESC LIMIT 1", userID).Scan(&postID); err != nil {
+		t.Fatalf("no post saved for user %d: %v", userID, err)
+	}
+	return postID
+}
+
+func TestSubmitSendsToModeration(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 600, "Guitar", "photo_1")
+
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 moderation message, got %d", len(msgs))
+	}
+	if msgs[0].ChatID != -1001 {
+		t.Errorf("expected moderation message in chat -1001, got %d", msgs[0].ChatID)
+	}
+	markup, ok := msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || len(markup.InlineKeyboard) != 1 || len(markup.InlineKeyboard[0]) != 2 {
+		t.Fatalf("expected Approve/Reject keyboard, got %#v", msgs[0].ReplyMarkup)
+	}
+	if data := *markup.InlineKeyboard[0][0].CallbackData; data != fmt.Sprintf("approve:%d", postID) {
+		t.Errorf("unexpected approve callback data %q", data)
+	}
+	// The photo goes first, the keyboard message replies to it
+	if photos := sender.Photos(); len(photos) != 1 || photos[0].ChatID != -1001 {
+		t.Fatalf("expected the photo in the moderation group, got %+v", photos)
+	}
+	if msgs[0].ReplyToMessageID != 1 {
+		t.Errorf("expected keyboard message to reply to the photo, got %d", msgs[0].ReplyToMessageID)
+	}
+	for _, messageID := range []int{1, 2} {
+		linked, err := db.FindPostByModerationMessage(dbConn, -1001, messageID)
+		if err != nil || linked != postID {
+			t.Errorf("expected moderation message %d linked to post %d, got %d (err=%v)", messageID, postID, linked, err)
+		}
+	}
+}
+
+func TestModerationBundleCleanedUpOnReject(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 605, "Lamp", "p1", "p2", "p3")
+	if groups := sender.MediaGroups(); len(groups) != 1 || len(groups[0].Media) != 3 {
+		t.Fatalf("expected a 3-photo album for the moderators, got %+v", groups)
+	}
+	refs, err := db.GetModerationMessages(dbConn, postID)
+	if err != nil || len(refs) != 4 {
+		t.Fatalf("expected album and keyboard message recorded, got %+v (err=%v)", refs, err)
+	}
+	sender.Reset()
+
+	if err := bot.RejectPost(dbConn, sender, postID, "no"); err != nil {
+		t.Fatalf("RejectPost failed: %v", err)
+	}
+	deletes := sender.Deletes()
+	if len(deletes) != 4 {
+		t.Fatalf("expected all 4 moderation messages deleted, got %+v", deletes)
+	}
+	for i, d := range deletes {
+		if d.ChatID != -1001 || d.MessageID != i+1 {
+			t.Errorf("unexpected delete %+v", d)
+		}
+	}
+}
+
+func TestModerationPreviewInGroupLanguage(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 609, "Stool")
+	bot.HandleMessageWithDB(dbConn, 609, "done", sender, 609, 3, nil, -1001, "cz")
+	sender.Reset()
+	// A Czech seller gets Czech replies, the moderators the group's language
+	resp := bot.HandleMessageWithDB(dbConn, 609, "confirm", sender, 609, 4, nil, -1001, "cz")
+	if resp != "Příspěvek byl odeslán ke schválení!" {
+		t.Errorf("expected a Czech reply to the seller, got %q", resp)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].Text != "New Sale Post:\nTitle: Stool\nDescription: Desc\nPrice: 10 €\nLocation: Brno\nStatus: pending" {
+		t.Fatalf("expected the moderation preview in English, got %+v", msgs)
+	}
+}
+
+func TestSubmitModerationSendFailure(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 601, "Desk")
+	bot.HandleMessageWithDB(dbConn, 601, "done", sender, 601, 3, nil, -1001, "en")
+	sender.SendErr = fmt.Errorf("network down")
+	resp := bot.HandleMessageWithDB(dbConn, 601, "confirm", sender, 601, 4, nil, -1001, "en")
+	if resp != "Post saved, but failed to forward to moderation group." {
+		t.Errorf("unexpected response: %q", resp)
+	}
+	if state := mustSession(t, 601).State; state != fsm.StateIdle {
+		t.Errorf("expected StateIdle after failed forward, got %d", state)
+	}
+}
+
+func TestApprovePostPublishes(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 602, "Sofa", "photo_a", "photo_b")
+	if _, err := dbConn.Exec("INSERT OR REPLACE INTO users (id, username) VALUES (602, 'seller_1')"); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	sender.Reset()
+
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	// One album, the listing as the caption of its first photo
+	if msgs, photos := sender.Messages(), sender.Photos(); len(msgs) != 0 || len(photos) != 0 {
+		t.Errorf("expected no separate text or photo messages, got %+v %+v", msgs, photos)
+	}
+	groups := sender.MediaGroups()
+	if len(groups) != 1 || groups[0].ChatID != -1002 || len(groups[0].Media) != 2 {
+		t.Fatalf("expected one album of 2 photos in approved group, got %+v", groups)
+	}
+	first := groups[0].Media[0].(tgbotapi.InputMediaPhoto)
+	if !strings.HasPrefix(first.Caption, "FOR SALE\\!\nTitle: Sofa") || first.ParseMode != "MarkdownV2" {
+		t.Errorf("expected listing as MarkdownV2 caption, got %q (%q)", first.Caption, first.ParseMode)
+	}
+	if second := groups[0].Media[1].(tgbotapi.InputMediaPhoto); second.Caption != "" {
+		t.Errorf("expected only the first photo captioned, got %q", second.Caption)
+	}
+	deletes := sender.Deletes()
+	// The moderation album (messages 1 and 2) and the keyboard message (3)
+	if len(deletes) != 3 || deletes[0].ChatID != -1001 || deletes[0].MessageID != 1 || deletes[2].MessageID != 3 {
+		t.Errorf("expected moderation messages -1001/1-3 to be deleted, got %+v", deletes)
+	}
+	var status string
+	dbConn.QueryRow("SELECT status FROM posts WHERE id = ?", postID).Scan(&status)
+	if status != "approved" {
+		t.Errorf("expected status approved, got %q", status)
+	}
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err == nil {
+		t.Errorf("expected second approval to fail")
+	}
+}
+
+func TestListingLinksSellerWithoutUsername(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 610, "Chair (oak) [used]")
+	sender.Reset()
+
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected the listing as text, got %+v", msgs)
+	}
+	text := msgs[0].Text
+	if !strings.HasSuffix(text, "Posted by: [user](tg://user?id=610)") {
+		t.Errorf("expected the seller linked by ID, got %q", text)
+	}
+	if !strings.Contains(text, "Title: Chair \\(oak\\) \\[used\\]") {
+		t.Errorf("expected the fields still escaped, got %q", text)
+	}
+}
+
+func TestApprovePostLongListingFallsBackToText(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 604, "Sofa", "photo_a")
+	if _, err := dbConn.Exec("UPDATE posts SET description = ? WHERE id = ?", strings.Repeat("long ", 250), postID); err != nil {
+		t.Fatalf("Failed to update post: %v", err)
+	}
+	sender.Reset()
+
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	sent := sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected listing text and photo, got %+v", sent)
+	}
+	msg, ok := sent[0].(tgbotapi.MessageConfig)
+	if !ok || !strings.HasPrefix(msg.Text, "FOR SALE") {
+		t.Errorf("expected listing text first, got %+v", sent[0])
+	}
+	if photo, ok := sent[1].(tgbotapi.PhotoConfig); !ok || photo.Caption != "" {
+		t.Errorf("expected uncaptioned photo after the text, got %+v", sent[1])
+	}
+}
+
+func TestApprovePostRecordsPublishedMessages(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 605, "Lamp", "photo_a", "photo_b")
+	db.SetConfig(dbConn, "APPROVED_TOPIC_ID", "42")
+	sender.Reset()
+
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	published, err := db.GetPublishedMessages(dbConn, postID)
+	if err != nil {
+		t.Fatalf("GetPublishedMessages failed: %v", err)
+	}
+	want := []db.PublishedMessage{
+		{MessageRef: db.MessageRef{ChatID: -1002, MessageID: 1}, ThreadID: 42, Kind: db.PublishedCaption},
+		{MessageRef: db.MessageRef{ChatID: -1002, MessageID: 2}, ThreadID: 42, Kind: db.PublishedPhoto},
+	}
+	if !reflect.DeepEqual(published, want) {
+		t.Errorf("expected published messages %+v, got %+v", want, published)
+	}
+}
+
+func TestApprovePostSendFailureStaysPending(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 606, "Chair", "photo_a")
+	sender.Reset()
+	sender.SendErr = fmt.Errorf("network down")
+
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err == nil {
+		t.Fatalf("expected ApprovePost to fail")
+	}
+	if status := postStatus(t, dbConn, postID); status != "pending" {
+		t.Errorf("expected post to stay pending for another try, got %q", status)
+	}
+	if published, _ := db.GetPublishedMessages(dbConn, postID); len(published) != 0 {
+		t.Errorf("expected no published messages, got %+v", published)
+	}
+	if deletes := sender.Deletes(); len(deletes) != 0 {
+		t.Errorf("expected the moderation messages to stay, got %+v", deletes)
+	}
+}
+
+// racingSender rejects the post while its approval is being sent, like a
+// second moderator pressing Reject at the same time.
+type racingSender struct {
+	*bottest.Recorder
+	dbConn *sql.DB
+	postID int64
+}
+
+func (s racingSender) SendMediaGroup(config tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error) {
+	s.dbConn.Exec("UPDATE posts SET status = 'rejected' WHERE id = ?", s.postID)
+	return s.Recorder.SendMediaGroup(config)
+}
+
+func TestApprovePostLosesRace(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	recorder := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, recorder, 607, "Shelf", "photo_a", "photo_b")
+	recorder.Reset()
+
+	err := bot.ApprovePost(dbConn, racingSender{recorder, dbConn, postID}, postID, -1002)
+	if !errors.Is(err, bot.ErrPostNotPending) {
+		t.Fatalf("expected ErrPostNotPending, got %v", err)
+	}
+	if status := postStatus(t, dbConn, postID); status != "rejected" {
+		t.Errorf("expected the rejection to stand, got %q", status)
+	}
+	// The album that went out must be taken down again
+	deletes := recorder.Deletes()
+	if len(deletes) != 2 || deletes[0].ChatID != -1002 || deletes[0].MessageID != 1 || deletes[1].MessageID != 2 {
+		t.Errorf("expected the published album to be deleted, got %+v", deletes)
+	}
+	if published, _ := db.GetPublishedMessages(dbConn, postID); len(published) != 0 {
+		t.Errorf("expected no published messages, got %+v", published)
+	}
+}
+
+func TestRejectPostNotifiesSeller(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 603, "Table")
+	sender.Reset()
+
+	if err := bot.RejectPost(dbConn, sender, postID, "blurry photos"); err != nil {
+		t.Fatalf("RejectPost failed: %v", err)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != 603 || msgs[0].Text != "Your post was rejected: blurry photos" {
+		t.Fatalf("expected rejection notice to seller, got %+v", msgs)
+	}
+	if deletes := sender.Deletes(); len(deletes) != 1 || deletes[0].MessageID != 1 {
+		t.Errorf("expected moderation message to be deleted, got %+v", deletes)
+	}
+	var status string
+	dbConn.QueryRow("SELECT status FROM posts WHERE id = ?", postID).Scan(&status)
+	if status != "rejected" {
+		t.Errorf("expected status rejected, got %q", status)
+	}
+	if err := bot.RejectPost(dbConn, sender, postID, "again"); err == nil {
+		t.Errorf("expected second rejection to fail")
+	}
+}
+
+func TestPreviewShowsAlbumAndWaitsForConfirm(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 604, "Bike", "photo_1", "photo_2", "photo_3")
+
+	resp := bot.HandleMessageWithDB(dbConn, 604, "done", sender, 604, 3, nil, -1001, "en")
+	if mustSession(t, 604).State != fsm.StatePreview {
+		t.Fatalf("expected StatePreview after done")
+	}
+	if want := "Preview:\nTitle: Bike"; len(resp) < len(want) || resp[:len(want)] != want {
+		t.Errorf("unexpected preview: %q", resp)
+	}
+	albums := sender.MediaGroups()
+	if len(albums) != 1 || albums[0].ChatID != 604 || len(albums[0].Media) != 3 {
+		t.Fatalf("expected a 3-photo album sent to the user, got %+v", albums)
+	}
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = 604").Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no post before confirm, got %d", count)
+	}
+	if len(sender.Messages()) != 0 {
+		t.Errorf("expected nothing sent to moderation before confirm")
+	}
+
+	resp = bot.HandleMessageWithDB(dbConn, 604, "something", sender, 604, 4, nil, -1001, "en")
+	if resp != "Send 'confirm' to submit or 'cancel' to abort." || mustSession(t, 604).State != fsm.StatePreview {
+		t.Errorf("expected to stay in preview, got %q", resp)
+	}
+
+	resp = bot.HandleMessageWithDB(dbConn, 604, "cancel", sender, 604, 5, nil, -1001, "en")
+	if resp != "Post creation cancelled." {
+		t.Errorf("unexpected cancel response: %q", resp)
+	}
+	session := mustSession(t, 604)
+	if session.State != fsm.StateIdle || len(session.PostData) != 0 {
+		t.Errorf("expected draft discarded, got %+v", session)
+	}
+	dbConn.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = 604").Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no post after cancel, got %d", count)
+	}
+}
+
+func TestPreviewSinglePhotoIsNotAnAlbum(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 605, "Hat", "photo_1")
+	bot.HandleMessageWithDB(dbConn, 605, "done", sender, 605, 3, nil, -1001, "en")
+	if len(sender.MediaGroups()) != 0 {
+		t.Errorf("expected no media group for a single photo")
+	}
+	if photos := sender.Photos(); len(photos) != 1 || photos[0].ChatID != 605 {
+		t.Errorf("expected single photo sent to the user, got %+v", photos)
+	}
+}
+
+func TestEditFieldFromPreview(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 606, "Tabel", "photo_1")
+	bot.HandleMessageWithDB(dbConn, 606, "done", sender, 606, 3, nil, -1001, "en")
+
+	resp := bot.HandleMessageWithDB(dbConn, 606, "edit:title", sender, 606, 4, nil, -1001, "en")
+	session := mustSession(t, 606)
+	if resp != "Enter the title:" || session.State != fsm.StateTitle || !session.Editing {
+		t.Fatalf("expected title prompt in edit mode, got %q state=%d editing=%v", resp, session.State, session.Editing)
+	}
+	resp = bot.HandleMessageWithDB(dbConn, 606, "Table", sender, 606, 5, nil, -1001, "en")
+	if session.State != fsm.StatePreview || session.Editing {
+		t.Fatalf("expected to return to preview after edit, got state=%d editing=%v", session.State, session.Editing)
+	}
+	if want := "Preview:\nTitle: Table\nDescription: Desc\nPrice: 10 €\nLocation: Brno\nPhotos: 1"; resp != want {
+		t.Errorf("unexpected preview after edit: %q", resp)
+	}
+
+	resp = bot.HandleMessageWithDB(dbConn, 606, "edit:photos", sender, 606, 6, nil, -1001, "en")
+	if session.State != fsm.StatePhotos || session.PostData["photos"] != nil {
+		t.Fatalf("expected photos cleared and StatePhotos, got state=%d photos=%v", session.State, session.PostData["photos"])
+	}
+	bot.HandleMessageWithDB(dbConn, 606, "", sender, 606, 7, testPhotos("photo_2"), -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 606, "", sender, 606, 8, testPhotos("photo_3"), -1001, "en")
+	resp = bot.HandleMessageWithDB(dbConn, 606, "done", sender, 606, 9, nil, -1001, "en")
+	if session.State != fsm.StatePreview || session.Editing {
+		t.Fatalf("expected preview after editing photos, got state=%d", session.State)
+	}
+	if photos := session.PostData["photos"].([]fsm.Photo); len(photos) != 2 || photos[0].FileID != "photo_2" {
+		t.Errorf("expected replaced photos, got %v", photos)
+	}
+
+	resp = bot.HandleMessageWithDB(dbConn, 606, "edit:bogus", sender, 606, 10, nil, -1001, "en")
+	if session.State != fsm.StatePreview {
+		t.Errorf("unknown edit field should keep the preview, got state=%d", session.State)
+	}
+}
+
+func TestEditingFlagPersisted(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	store := db.NewSessionStore(dbConn)
+	if err := store.SaveSession(&fsm.UserSession{UserID: 607, State: fsm.StatePrice, PostData: map[string]interface{}{"price": "5"}, Editing: true}); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	loaded, err := store.LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions failed: %v", err)
+	}
+	if !loaded[607].Editing {
+		t.Errorf("expected Editing to survive reload")
+	}
+}
+
+func TestCancelCommandInEveryState(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	userID := int64(608)
+	fsm.Delete(userID)
+	if resp := bot.HandleMessageWithDB(dbConn, userID, "/cancel", sender, userID, 1, nil, -1001, "en"); resp != "There is nothing to cancel. Send /start to begin." {
+		t.Errorf("unexpected /cancel response when idle: %q", resp)
+	}
+	inputs := []string{"/start", "Title", "Desc", "10", "Brno", "done"}
+	for steps := 1; steps <= len(inputs); steps++ {
+		fsm.Delete(userID)
+		for _, text := range inputs[:steps] {
+			bot.HandleMessageWithDB(dbConn, userID, text, sender, userID, 1, nil, -1001, "en")
+		}
+		state := mustSession(t, userID).State
+		resp := bot.HandleMessageWithDB(dbConn, userID, "/cancel", sender, userID, 2, nil, -1001, "en")
+		session := mustSession(t, userID)
+		if resp != "Post creation cancelled." || session.State != fsm.StateIdle || len(session.PostData) != 0 {
+			t.Errorf("state %d: /cancel gave %q, state=%d, data=%v", state, resp, session.State, session.PostData)
+		}
+	}
+}
+
+func TestGlobalCommandsIgnoredInGroups(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	userID := int64(609)
+	fsm.Delete(userID)
+	for _, chatID := range []int64{-1001, -1002} {
+		for _, text := range []string{"/cancel", "/back"} {
+			if resp := bot.HandleMessageWithDB(dbConn, userID, text, sender, chatID, 1, nil, -1001, "en"); resp != "" {
+				t.Errorf("expected %s in group %d to be ignored, got %q", text, chatID, resp)
+			}
+		}
+	}
+	if len(sender.Sent()) != 0 {
+		t.Errorf("expected nothing sent to the groups, got %+v", sender.Sent())
+	}
+}
+
+func TestBackCommandShowsCurrentValue(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	userID := int64(609)
+	runWizard(t, dbConn, sender, userID, "Lamp", "photo_1")
+	session := mustSession(t, userID)
+
+	resp := bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 1, nil, -1001, "en")
+	if session.State != fsm.StateLocation || resp != "Enter the location:\nCurrent value: Brno" {
+		t.Fatalf("expected location with current value, got %q state=%d", resp, session.State)
+	}
+	resp = bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 2, nil, -1001, "en")
+	if session.State != fsm.StatePrice || resp != "Enter the price:\nCurrent value: 10" {
+		t.Fatalf("expected price with current value, got %q state=%d", resp, session.State)
+	}
+	bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 3, nil, -1001, "en")
+	resp = bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 4, nil, -1001, "en")
+	if session.State != fsm.StateTitle || resp != "Enter the title:\nCurrent value: Lamp" {
+		t.Fatalf("expected title with current value, got %q state=%d", resp, session.State)
+	}
+	resp = bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 5, nil, -1001, "en")
+	if session.State != fsm.StateTitle {
+		t.Errorf("/back on the first field should stay there, got state=%d", session.State)
+	}
+	if session.PostData["title"] != "Lamp" {
+		t.Errorf("/back must not be stored as a field value, title=%v", session.PostData["title"])
+	}
+
+	// Walking forward again keeps the photos
+	for _, text := range []string{"Lamp 2", "Desc", "10", "Brno"} {
+		bot.HandleMessageWithDB(dbConn, userID, text, sender, userID, 6, nil, -1001, "en")
+	}
+	bot.HandleMessageWithDB(dbConn, userID, "done", sender, userID, 7, nil, -1001, "en")
+	resp = bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 8, nil, -1001, "en")
+	if session.State != fsm.StatePhotos || resp != "Send one or more photos (type 'done' when finished):\nPhotos so far: 1" {
+		t.Errorf("expected photo step from preview, got %q state=%d", resp, session.State)
+	}
+}
+
+func TestBackWhileEditingReturnsToPreview(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	userID := int64(610)
+	runWizard(t, dbConn, sender, userID, "Clock")
+	bot.HandleMessageWithDB(dbConn, userID, "done", sender, userID, 1, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, userID, "edit:price", sender, userID, 2, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 3, nil, -1001, "en")
+	session := mustSession(t, userID)
+	if session.State != fsm.StatePreview || session.Editing || session.PostData["price"] != "10" {
+		t.Errorf("expected unchanged preview, got state=%d editing=%v price=%v", session.State, session.Editing, session.PostData["price"])
+	}
+}
+
+func TestBackWhileEditingPhotosKeepsThem(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	userID := int64(611)
+	runWizard(t, dbConn, sender, userID, "Vase", "photo_a", "photo_b")
+	bot.HandleMessageWithDB(dbConn, userID, "done", sender, userID, 3, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, userID, "edit:photos", sender, userID, 4, nil, -1001, "en")
+	// The old photos survive a restart while they are set aside
+	store := db.NewSessionStore(dbConn)
+	if err := store.SaveSession(mustSession(t, userID)); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	loaded, err := store.LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions failed: %v", err)
+	}
+	if photos, ok := loaded[userID].PostData[fsm.PhotosBeforeEdit].([]fsm.Photo); !ok || len(photos) != 2 {
+		t.Errorf("expected the old photos stored aside, got %#v", loaded[userID].PostData[fsm.PhotosBeforeEdit])
+	}
+
+	resp := bot.HandleMessageWithDB(dbConn, userID, "/back", sender, userID, 5, nil, -1001, "en")
+	if !strings.HasSuffix(resp, "Photos: 2") {
+		t.Errorf("expected the preview with the original photos, got %q", resp)
+	}
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, userID, "confirm", sender, userID, 6, nil, -1001, "en")
+	var postID int64
+	if err := dbConn.QueryRow("SELECT id FROM posts WHERE user_id = ?", userID).Scan(&postID); err != nil {
+		t.Fatalf("no post saved: %v", err)
+	}
+	photos, err := db.GetPhotos(dbConn, postID)
+	if err != nil || len(photos) != 2 || photos[0].FileID != "photo_a" || photos[1].FileID != "photo_b" {
+		t.Errorf("expected the original photos to be submitted, got %+v (err=%v)", photos, err)
+	}
+}
+
+// insertPendingPost adds a pending post that expires at expiresAt and is
+// linked to moderation message -1001/modMessageID.
+func insertPendingPost(t *testing.T, dbConn *sql.DB, userID int64, title string, expiresAt time.Time, modMessageID int) int64 {
+	t.Helper()
+	res, err := dbConn.Exec(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, location, created_at, expires_at, moderation_chat_id, moderation_message_id)
+		VALUES (?, ?, 1, 'pending', ?, 'Desc', '10', 'Loc', ?, ?, -1001, ?)`,
+		userID, userID, title, db.FormatTime(expiresAt.Add(-24*time.Hour)), db.FormatTime(expiresAt), modMessageID)
+	if err != nil {
+		t.Fatalf("Failed to insert post: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+func postStatus(t *testing.T, dbConn *sql.DB, postID int64) string {
+	t.Helper()
+	var status string
+	if err := dbConn.QueryRow("SELECT status FROM posts WHERE id = ?", postID).Scan(&status); err != nil {
+		t.Fatalf("Failed to read status of post %d: %v", postID, err)
+	}
+	return status
+}
+
+func TestExpirePostsReject(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	clock := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.SetConfig(dbConn, "EXPIRY_POLICY", bot.ExpiryReject)
+	overdue := insertPendingPost(t, dbConn, 700, "Old bike", clock.Add(-time.Minute), 50)
+	fresh := insertPendingPost(t, dbConn, 701, "New bike", clock.Add(time.Hour), 51)
+
+	n, err := bot.ExpirePosts(dbConn, sender, clock.Add(-2*time.Minute), -1001, -1002)
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing expired before the deadline, got %d (err=%v)", n, err)
+	}
+	n, err = bot.ExpirePosts(dbConn, sender, clock, -1001, -1002)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 expired post, got %d (err=%v)", n, err)
+	}
+	if got := postStatus(t, dbConn, overdue); got != "expired" {
+		t.Errorf("expected overdue post expired, got %q", got)
+	}
+	if got := postStatus(t, dbConn, fresh); got != "pending" {
+		t.Errorf("expected fresh post still pending, got %q", got)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != 700 {
+		t.Fatalf("expected seller notification, got %+v", msgs)
+	}
+	if deletes := sender.Deletes(); len(deletes) != 1 || deletes[0].MessageID != 50 {
+		t.Errorf("expected moderation message 50 deleted, got %+v", deletes)
+	}
+	// Already expired posts are not handled again
+	if n, _ := bot.ExpirePosts(dbConn, sender, clock, -1001, -1002); n != 0 {
+		t.Errorf("expected expired post to be handled once, got %d", n)
+	}
+}
+
+func TestExpirePostsEscalate(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	t.Setenv("ADMINS", "42,7")
+	bot.LoadAdminsFromEnv()
+	sender := &bottest.Recorder{}
+	clock := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.SetConfig(dbConn, "EXPIRY_POLICY", bot.ExpiryEscalate)
+	db.SetConfig(dbConn, "TIMEOUT_MINUTES", "60")
+	postID := insertPendingPost(t, dbConn, 702, "Lamp", clock.Add(-time.Minute), 52)
+
+	n, err := bot.ExpirePosts(dbConn, sender, clock, -1001, -1002)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 escalated post, got %d (err=%v)", n, err)
+	}
+	if got := postStatus(t, dbConn, postID); got != "pending" {
+		t.Errorf("escalated post should stay pending, got %q", got)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != -1001 || msgs[0].ReplyToMessageID != 52 {
+		t.Fatalf("expected reminder replying to the moderation message, got %+v", msgs)
+	}
+	if !strings.Contains(msgs[0].Text, "tg://user?id=7") || !strings.Contains(msgs[0].Text, "tg://user?id=42") {
+		t.Errorf("expected admins to be mentioned, got %q", msgs[0].Text)
+	}
+	// The next reminder only comes after another timeout period
+	if n, _ := bot.ExpirePosts(dbConn, sender, clock.Add(59*time.Minute), -1001, -1002); n != 0 {
+		t.Errorf("expected no reminder within the new period, got %d", n)
+	}
+	if n, _ := bot.ExpirePosts(dbConn, sender, clock.Add(61*time.Minute), -1001, -1002); n != 1 {
+		t.Errorf("expected a second reminder after the new period, got %d", n)
+	}
+}
+
+func TestEscalationReminderIsModerated(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	clock := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.SetConfig(dbConn, "EXPIRY_POLICY", bot.ExpiryEscalate)
+	postID := insertPendingPost(t, dbConn, 703, "Desk", clock.Add(-time.Minute), 53)
+
+	if n, err := bot.ExpirePosts(dbConn, sender, clock, -1001, -1002); err != nil || n != 1 {
+		t.Fatalf("expected 1 escalated post, got %d (err=%v)", n, err)
+	}
+	reminder := sender.Messages()[0]
+	reminderID := 1
+	if linked, err := db.FindPostByModerationMessage(dbConn, -1001, reminderID); err != nil || linked != postID {
+		t.Fatalf("expected reminder linked to post %d, got %d (err=%v)", postID, linked, err)
+	}
+
+	// A moderator approves by replying to the reminder
+	handleUpdate(dbConn, sender, newAlbumAcks(sender, time.Millisecond), tgbotapi.Update{Message: &tgbotapi.Message{
+		MessageID: 99,
+		From:      &tgbotapi.User{ID: 42},
+		Chat:      &tgbotapi.Chat{ID: -1001, Type: "supergroup"},
+		Text:      "/approve",
+		ReplyToMessage: &tgbotapi.Message{
+			MessageID: reminderID,
+			Chat:      &tgbotapi.Chat{ID: reminder.ChatID},
+		},
+	}}, -1001, -1002)
+	if got := postStatus(t, dbConn, postID); got != "approved" {
+		t.Fatalf("expected post approved from the reminder, got %q", got)
+	}
+	deleted := map[int]bool{}
+	for _, d := range sender.Deletes() {
+		deleted[d.MessageID] = true
+	}
+	if !deleted[53] || !deleted[reminderID] {
+		t.Errorf("expected moderation message and reminder deleted, got %+v", sender.Deletes())
+	}
+}
+
+func TestExpirePostsApprove(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	clock := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	db.SetConfig(dbConn, "EXPIRY_POLICY", bot.ExpiryApprove)
+	postID := insertPendingPost(t, dbConn, 703, "Chair", clock.Add(-time.Minute), 53)
+
+	n, err := bot.ExpirePosts(dbConn, sender, clock, -1001, -1002)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 auto-approved post, got %d (err=%v)", n, err)
+	}
+	if got := postStatus(t, dbConn, postID); got != "approved" {
+		t.Errorf("expected post approved, got %q", got)
+	}
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].ChatID != -1002 {
+		t.Errorf("expected listing published to approved group, got %+v", msgs)
+	}
+}
+
+func TestExpiryFollowsLiveTimeout(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	postData := map[string]interface{}{"title": "Kettle", "description": "d", "price": "1", "location": "l"}
+	expiryWindow := func(postID int64) time.Duration {
+		t.Helper()
+		var createdAt, expiresAt string
+		if err := dbConn.QueryRow("SELECT created_at, expires_at FROM posts WHERE id = ?", postID).Scan(&createdAt, &expiresAt); err != nil {
+			t.Fatalf("Failed to read post: %v", err)
+		}
+		created, err1 := time.Parse(time.RFC3339, createdAt)
+		expires, err2 := time.Parse(time.RFC3339, expiresAt)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("Failed to parse times %q/%q: %v %v", createdAt, expiresAt, err1, err2)
+		}
+		return expires.Sub(created)
+	}
+
+	first, err := db.SavePostToDB(dbConn, 1, postData)
+	if err != nil {
+		t.Fatalf("SavePostToDB failed: %v", err)
+	}
+	if got := expiryWindow(first); got != 24*time.Hour {
+		t.Errorf("expected default 24h expiry, got %s", got)
+	}
+
+	// A /config change applies to the next post without a restart
+	t.Setenv("ADMINS", "1")
+	bot.LoadAdminsFromEnv()
+	resp := bot.HandleAdminCommand(dbConn, 1, "/config TIMEOUT_MINUTES 90")
+	if resp != "Config updated: TIMEOUT_MINUTES = 90" {
+		t.Fatalf("unexpected /config response: %q", resp)
+	}
+	second, err := db.SavePostToDB(dbConn, 1, postData)
+	if err != nil {
+		t.Fatalf("SavePostToDB failed: %v", err)
+	}
+	if got := expiryWindow(second); got != 90*time.Minute {
+		t.Errorf("expected 90m expiry after /config, got %s", got)
+	}
+}
+
+func TestConfigDefaultsDoNotOverwrite(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	if err := db.SetConfig(dbConn, "TIMEOUT_MINUTES", "30"); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	if err := db.SetConfigDefault(dbConn, "TIMEOUT_MINUTES", "1440"); err != nil {
+		t.Fatalf("SetConfigDefault failed: %v", err)
+	}
+	if got := db.PendingTimeout(dbConn); got != 30*time.Minute {
+		t.Errorf("expected admin value to survive defaults, got %s", got)
+	}
+	if got := db.PollInterval(dbConn); got != time.Duration(db.DefaultPollSeconds)*time.Second {
+		t.Errorf("expected default poll interval, got %s", got)
+	}
+	db.SetConfig(dbConn, "EXPIRY_POLL_SECONDS", "15")
+	if got := db.PollInterval(dbConn); got != 15*time.Second {
+		t.Errorf("expected 15s poll interval, got %s", got)
+	}
+	db.SetConfig(dbConn, "EXPIRY_POLL_SECONDS", "soon")
+	if got := db.PollInterval(dbConn); got != time.Duration(db.DefaultPollSeconds)*time.Second {
+		t.Errorf("expected invalid poll interval to fall back to default, got %s", got)
+	}
+}
+
+func TestMigrateOldDatabase(t *testing.T) {
+	dbConn, err := sql.Open("sqlite3", t.TempDir()+"/old.db")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer dbConn.Close()
+	// Schema and data as left behind by 0.1.0, before migrations existed
+	_, err = dbConn.Exec(`
+		CREATE TABLE posts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			chat_id INTEGER NOT NULL,
+			message_id INTEGER NOT NULL,
+			status TEXT NOT NULL CHECK(status IN ('pending', 'approved', 'rejected')),
+			title TEXT,
+			description TEXT,
+			price TEXT,
+			location TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME
+		);
+		CREATE TABLE photos (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+			file_id TEXT NOT NULL
+		);
+		CREATE TABLE config (key TEXT PRIMARY KEY, value TEXT);
+		CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT);
+		INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, location, expires_at)
+			VALUES (5, 5, 10, 'approved', 'Old bike', 'Rusty', '20', 'Brno', '2024-01-02 00:00:00');
+		INSERT INTO photos (post_id, file_id) VALUES (1, 'old_photo');
+		INSERT INTO config (key, value) VALUES ('TIMEOUT_MINUTES', '30');
+		INSERT INTO users (id, username) VALUES (5, 'seller');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	if err := db.Migrate(dbConn); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	version, err := db.SchemaVersion(dbConn)
+	if err != nil || version < 4 {
+		t.Fatalf("expected schema version >= 4, got %d (err=%v)", version, err)
+	}
+
+	var title, status, fileID, username, timeout string
+	if err := dbConn.QueryRow("SELECT title, status FROM posts WHERE id = 1").Scan(&title, &status); err != nil || title != "Old bike" || status != "approved" {
+		t.Errorf("post not preserved: %q %q (err=%v)", title, status, err)
+	}
+	if err := dbConn.QueryRow("SELECT file_id FROM photos WHERE post_id = 1").Scan(&fileID); err != nil || fileID != "old_photo" {
+		t.Errorf("photo not preserved: %q (err=%v)", fileID, err)
+	}
+	if err := dbConn.QueryRow("SELECT username FROM users WHERE id = 5").Scan(&username); err != nil || username != "seller" {
+		t.Errorf("user not preserved: %q (err=%v)", username, err)
+	}
+	if err := dbConn.QueryRow("SELECT value FROM config WHERE key = 'TIMEOUT_MINUTES'").Scan(&timeout); err != nil || timeout != "30" {
+		t.Errorf("config not preserved: %q (err=%v)", timeout, err)
+	}
+
+	// The new columns, status and tables are usable
+	if err := db.SetModerationMessage(dbConn, 1, -1001, 99); err != nil {
+		t.Errorf("moderation columns missing: %v", err)
+	}
+	if _, err := dbConn.Exec("UPDATE posts SET status = 'expired' WHERE id = 1"); err != nil {
+		t.Errorf("expired status not allowed after migration: %v", err)
+	}
+	if err := db.NewSessionStore(dbConn).SaveSession(&fsm.UserSession{UserID: 5, State: fsm.StateTitle, PostData: map[string]interface{}{}}); err != nil {
+		t.Errorf("sessions table missing: %v", err)
+	}
+	if _, err := db.SavePostToDB(dbConn, 5, map[string]interface{}{"title": "New", "photos": testPhotos("p")}); err != nil {
+		t.Errorf("failed to save post after migration: %v", err)
+	}
+
+	// Running again is a no-op
+	if err := db.Migrate(dbConn); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+	again, _ := db.SchemaVersion(dbConn)
+	if again != version {
+		t.Errorf("schema version changed on re-run: %d -> %d", version, again)
+	}
+}
+
+func TestUserLanguage(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	t.Setenv("LANG", "en")
+
+	if got := bot.UserLang(dbConn, 800, ""); got != "en" {
+		t.Errorf("expected LANG fallback for unknown user, got %q", got)
+	}
+	// Telegram's "cs" is our "cz", and the detected value is stored
+	if got := bot.UserLang(dbConn, 801, "cs"); got != "cz" {
+		t.Errorf("expected cz from Telegram code cs, got %q", got)
+	}
+	if stored, _ := db.GetUserLang(dbConn, 801); stored != "cz" {
+		t.Errorf("expected detected language to be stored, got %q", stored)
+	}
+	if got := bot.UserLang(dbConn, 802, "pt-BR"); got != "en" {
+		t.Errorf("expected fallback for unsupported Telegram code, got %q", got)
+	}
+
+	// An explicit choice wins over the client language
+	resp, handled := bot.HandleLanguageCallback(dbConn, 801, "lang:he")
+	if !handled || resp != "השפה הוגדרה לעברית." {
+		t.Errorf("unexpected language callback response %q (handled=%v)", resp, handled)
+	}
+	if got := bot.UserLang(dbConn, 801, "cs"); got != "he" {
+		t.Errorf("expected stored choice he, got %q", got)
+	}
+	if _, handled := bot.HandleLanguageCallback(dbConn, 801, "approve:1"); handled {
+		t.Errorf("non-language callback should not be handled")
+	}
+	if resp, _ := bot.HandleLanguageCallback(dbConn, 801, "lang:xx"); resp != "" || bot.UserLang(dbConn, 801, "") != "he" {
+		t.Errorf("unknown language must not be stored")
+	}
+
+	markup := bot.LanguageKeyboard()
+	var labels []string
+	for _, btn := range markup.InlineKeyboard[0] {
+		labels = append(labels, btn.Text+"="+*btn.CallbackData)
+	}
+	if got := strings.Join(labels, ","); got != "Čeština=lang:cz,English=lang:en,עברית=lang:he" {
+		t.Errorf("unexpected language keyboard: %s", got)
+	}
+}
+
+func TestRejectionUsesSellerLanguage(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 803, "Kolo")
+	if err := db.SetUserLang(dbConn, 803, "cz"); err != nil {
+		t.Fatalf("SetUserLang failed: %v", err)
+	}
+	sender.Reset()
+	if err := bot.RejectPost(dbConn, sender, postID, "rozmazané"); err != nil {
+		t.Fatalf("RejectPost failed: %v", err)
+	}
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].Text != "Váš příspěvek byl zamítnut: rozmazané" {
+		t.Errorf("expected Czech rejection notice, got %+v", msgs)
+	}
+}
+
+// userTextArgs maps tgbotapi constructors to the index of their argument that
+// is shown to users. Such text must come from i18n.T, never a literal.
+var userTextArgs = map[string]int{
+	"NewMessage":                  1,
+	"NewEditMessageText":          2,
+	"NewEditMessageCaption":       2,
+	"NewInlineKeyboardButtonData": 0,
+}
+
+// markdownLinkLabel matches a Markdown link whose label is written out, like
+// "[user](tg://...)", rather than filled in with %s.
+var markdownLinkLabel = regexp.MustCompile(`\[[^\]%]*\pL[^\]%]*\]\(`)
+
+// TestNoHardcodedUserText parses every non-test source file and fails for
+// each string literal passed as user-facing text to tgbotapi or assigned to a
+// Caption, and for fmt.Sprintf formats that write out the label of a Markdown
+// link, since those only end up in message text.
+func TestNoHardcodedUserText(t *testing.T) {
+	fset := token.NewFileSet()
+	hasLiteral := func(expr ast.Expr) bool {
+		found := false
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				found = true
+			}
+			// Text produced by a call (i18n.T, a helper) is not a literal, and
+			// the literals passed to it are keys or formats
+			_, isCall := n.(*ast.CallExpr)
+			return !isCall
+		})
+		return found
+	}
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "fmt" && sel.Sel.Name == "Sprintf" && len(n.Args) > 0 {
+					if lit, ok := n.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING && markdownLinkLabel.MatchString(lit.Value) {
+						t.Errorf("%s: link label in fmt.Sprintf format; use i18n.T", fset.Position(n.Pos()))
+					}
+				}
+				if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "tgbotapi" {
+					return true
+				}
+				if i, ok := userTextArgs[sel.Sel.Name]; ok && i < len(n.Args) && hasLiteral(n.Args[i]) {
+					t.Errorf("%s: string literal passed to tgbotapi.%s; use i18n.T", fset.Position(n.Pos()), sel.Sel.Name)
+				}
+			case *ast.AssignStmt:
+				for i, lhs := range n.Lhs {
+					if sel, ok := lhs.(*ast.SelectorExpr); ok && sel.Sel.Name == "Caption" && i < len(n.Rhs) && hasLiteral(n.Rhs[i]) {
+						t.Errorf("%s: string literal assigned to Caption; use i18n.T", fset.Position(n.Pos()))
+					}
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to scan sources: %v", err)
+	}
+}
+
+func TestButtonsAndAdminRepliesAreLocalized(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	t.Setenv("ADMINS", "42")
+	bot.LoadAdminsFromEnv()
+	if err := db.SetUserLang(dbConn, 42, "cz"); err != nil {
+		t.Fatalf("SetUserLang failed: %v", err)
+	}
+
+	markup := bot.StateKeyboard(fsm.StatePreview, "cz")
+	if markup == nil || markup.InlineKeyboard[0][0].Text != "✅ Potvrdit" {
+		t.Errorf("expected Czech preview buttons, got %+v", markup)
+	}
+	markup = bot.StateKeyboard(fsm.StatePhotos, "he")
+	if markup == nil || markup.InlineKeyboard[0][0].Text != "סיום" {
+		t.Errorf("expected Hebrew done button, got %+v", markup)
+	}
+	if resp := bot.HandleAdminCommand(dbConn, 42, "/config FOO BAR"); resp != "Nastavení uloženo: FOO = BAR" {
+		t.Errorf("expected Czech admin reply, got %q", resp)
+	}
+	// main routes everything starting with /config here; /configure is not a command
+	if resp := bot.HandleAdminCommand(dbConn, 42, "/configure"); resp != "Neznámý administrátorský příkaz." {
+		t.Errorf("expected Czech unknown command reply, got %q", resp)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/")
+
+// TestApprovedListingGolden renders approved listings whose fields mix
+// directions, and the structured price kinds in every locale, and compares
+// them with testdata/*.golden. Run with -update after an intended change and
+// review the diff.
+func TestApprovedListingGolden(t *testing.T) {
+	type goldenListing struct {
+		name, lang, title, description, price, location string
+		// The structured price; priceKind is empty for legacy listings,
+		// which only have the price as typed
+		priceKind, priceCurrency string
+		priceAmount              int64
+	}
+	cases := []goldenListing{
+		{name: "he_mixed", lang: "he", title: "ספה IKEA Ektorp", description: "במצב מצוין, ראו https://example.com/sofa", price: "1500 CZK", location: "Praha 5"},
+		{name: "he_latin", lang: "he", title: "Sofa", description: "Like new", price: "1500", location: "Brno"},
+		{name: "en_hebrew", lang: "en", title: "ספה", description: "Like new", price: "1500 CZK", location: "תל אביב"},
+	}
+	for _, lang := range []string{"en", "cz", "he"} {
+		cases = append(cases,
+			goldenListing{name: lang + "_fixed", lang: lang, title: "Sofa", description: "Like new", price: "1500.50 Kč", location: "Brno", priceKind: bot.PriceFixed, priceCurrency: "CZK", priceAmount: 150050},
+			goldenListing{name: lang + "_free", lang: lang, title: "Sofa", description: "Like new", price: "free", location: "Brno", priceKind: bot.PriceFree},
+			goldenListing{name: lang + "_negotiable", lang: lang, title: "Sofa", description: "Like new", price: "negotiable", location: "Brno", priceKind: bot.PriceNegotiable},
+		)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("LANG", c.lang)
+			dbConn := setupTestDB(t)
+			defer dbConn.Close()
+			var priceKind, priceCurrency, priceAmount interface{}
+			if c.priceKind != "" {
+				priceKind = c.priceKind
+			}
+			if c.priceKind == bot.PriceFixed {
+				priceCurrency, priceAmount = c.priceCurrency, c.priceAmount
+			}
+			res, err := dbConn.Exec(`INSERT INTO posts (user_id, chat_id, message_id, status, title, description, price, price_amount, price_currency, price_kind, location, created_at, expires_at)
+				VALUES (901, 901, 1, 'pending', ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now', '+24 hours'))`,
+				c.title, c.description, c.price, priceAmount, priceCurrency, priceKind, c.location)
+			if err != nil {
+				t.Fatalf("Failed to insert post: %v", err)
+			}
+			if _, err := dbConn.Exec("INSERT INTO users (id, username) VALUES (901, 'seller_1')"); err != nil {
+				t.Fatalf("Failed to insert user: %v", err)
+			}
+			postID, _ := res.LastInsertId()
+			sender := &bottest.Recorder{}
+			if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+				t.Fatalf("ApprovePost failed: %v", err)
+			}
+			msgs := sender.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("expected one listing, got %+v", msgs)
+			}
+			got := msgs[0].Text + "\n"
+
+			golden := filepath.Join("testdata", "approved_"+c.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatalf("failed to write %s: %v", golden, err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read %s (run with -update to create it): %v", golden, err)
+			}
+			if got != string(want) {
+				t.Errorf("listing differs from %s:\ngot  %q\nwant %q", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestAlbumAcksAnswerOnce(t *testing.T) {
+	sender := &bottest.Recorder{}
+	albums := newAlbumAcks(sender, 20*time.Millisecond)
+	for i, text := range []string{"1 photo", "2 photos", "3 photos"} {
+		msg := tgbotapi.NewMessage(700, text)
+		msg.ReplyToMessageID = 10 + i
+		albums.Add("album-1", msg)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(sender.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	msgs := sender.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected one reply for the album, got %+v", msgs)
+	}
+	if msgs[0].Text != "3 photos" || msgs[0].ReplyToMessageID != 10 {
+		t.Errorf("expected the last reply quoting the first photo, got %q replying to %d", msgs[0].Text, msgs[0].ReplyToMessageID)
+	}
+
+	// A reply the user has moved past is dropped
+	sender.Reset()
+	albums.Add("album-2", tgbotapi.NewMessage(700, "1 photo"))
+	albums.Add("album-3", tgbotapi.NewMessage(701, "1 photo"))
+	albums.Discard(700)
+	time.Sleep(100 * time.Millisecond)
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].ChatID != 701 {
+		t.Errorf("expected only the other chat's reply, got %+v", msgs)
+	}
+}
+
+func TestAlbumAcksIgnoreStaleTimer(t *testing.T) {
+	sender := &bottest.Recorder{}
+	albums := newAlbumAcks(sender, 20*time.Millisecond)
+	albums.Add("album-1", tgbotapi.NewMessage(700, "1 photo"))
+	stale := albums.pending["700:album-1"]
+	albums.Add("album-1", tgbotapi.NewMessage(700, "2 photos"))
+	// The first timer fired just before the second photo stopped it
+	albums.send("700:album-1", stale)
+	if msgs := sender.Messages(); len(msgs) != 0 {
+		t.Fatalf("expected the replaced reply to be dropped, got %+v", msgs)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].Text != "2 photos" {
+		t.Errorf("expected one reply with the final count, got %+v", msgs)
+	}
+}
+
+func TestMaxPhotosPerListing(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	if err := db.SetConfig(dbConn, "MAX_PHOTOS", "2"); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	runWizard(t, dbConn, sender, 710, "Chair")
+
+	resp := bot.HandleMessageWithDB(dbConn, 710, "", sender, 710, 2, testPhotos("p1"), -1001, "en")
+	if resp != "Photo received. Send another or type 'done'." {
+		t.Errorf("unexpected response to first photo: %q", resp)
+	}
+	resp = bot.HandleMessageWithDB(dbConn, 710, "", sender, 710, 3, testPhotos("p2", "p3"), -1001, "en")
+	if resp != "You can add at most 2 photos; the rest were skipped. Type 'done' to continue." {
+		t.Errorf("unexpected response over the limit: %q", resp)
+	}
+	photos, _ := mustSession(t, 710).PostData["photos"].([]fsm.Photo)
+	if len(photos) != 2 || photos[1].FileID != "p2" {
+		t.Errorf("expected the first 2 photos kept, got %v", photos)
+	}
+}
+
+func TestMessagePhotosKeepsLargestSize(t *testing.T) {
+	msg := &tgbotapi.Message{Photo: []tgbotapi.PhotoSize{
+		{FileID: "small", FileUniqueID: "u1", Width: 90, Height: 67},
+		{FileID: "large", FileUniqueID: "u1", Width: 1280, Height: 960, FileSize: 120000},
+		{FileID: "medium", FileUniqueID: "u1", Width: 320, Height: 240},
+	}}
+	photos := messagePhotos(msg)
+	if len(photos) != 1 || photos[0].FileID != "large" || photos[0].Width != 1280 || photos[0].FileSize != 120000 {
+		t.Errorf("expected only the largest size, got %+v", photos)
+	}
+
+	msg = &tgbotapi.Message{Document: &tgbotapi.Document{FileID: "doc", FileUniqueID: "u2", MimeType: "image/jpeg", FileSize: 5000000}}
+	if photos := messagePhotos(msg); len(photos) != 1 || !photos[0].Document || photos[0].FileSize != 5000000 {
+		t.Errorf("expected image document accepted as a photo, got %+v", photos)
+	}
+	msg = &tgbotapi.Message{Document: &tgbotapi.Document{FileID: "pdf", MimeType: "application/pdf"}}
+	if photos := messagePhotos(msg); photos != nil {
+		t.Errorf("expected non-image document ignored, got %+v", photos)
+	}
+}
+
+func TestDuplicatePhotos(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+
+	// Within one draft the same file counts once
+	runWizard(t, dbConn, sender, 720, "Bike", "bike_front")
+	resent := fsm.Photo{FileID: "other_file_id", FileUniqueID: "u-bike_front"}
+	resp := bot.HandleMessageWithDB(dbConn, 720, "", sender, 720, 3, []fsm.Photo{resent}, -1001, "en")
+	if resp != "You already added this photo. Send another or type 'done'." {
+		t.Errorf("unexpected response to a repeated photo: %q", resp)
+	}
+	if photos := mustSession(t, 720).PostData["photos"].([]fsm.Photo); len(photos) != 1 {
+		t.Errorf("expected the repeated photo skipped, got %+v", photos)
+	}
+	bot.HandleMessageWithDB(dbConn, 720, "done", sender, 720, 4, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 720, "confirm", sender, 720, 5, nil, -1001, "en")
+
+	stored, err := db.GetPhotos(dbConn, 1)
+	if err != nil || len(stored) != 1 || stored[0].FileUniqueID != "u-bike_front" || stored[0].Width != 800 {
+		t.Fatalf("expected photo metadata stored, got %+v (err=%v)", stored, err)
+	}
+
+	// Another listing reusing the photo is flagged to the moderators
+	sender.Reset()
+	postID := submitPost(t, dbConn, sender, 721, "Bike again", "bike_front")
+	dups, err := db.DuplicatePhotoPosts(dbConn, postID)
+	if err != nil || len(dups) != 1 || dups[0] != 1 {
+		t.Errorf("expected post 1 as duplicate, got %v (err=%v)", dups, err)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || !strings.HasSuffix(msgs[0].Text, "\n⚠️ Photos also used in post #1") {
+		t.Errorf("expected duplicate warning for moderators, got %+v", msgs)
+	}
+}
+
+func TestImageDocumentsSentAsDocuments(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	runWizard(t, dbConn, sender, 722, "Vase", "vase_1", "vase_2")
+	doc := fsm.Photo{FileID: "vase_scan", FileUniqueID: "u-vase_scan", Document: true}
+	bot.HandleMessageWithDB(dbConn, 722, "", sender, 722, 3, []fsm.Photo{doc}, -1001, "en")
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, 722, "done", sender, 722, 4, nil, -1001, "en")
+
+	// Telegram can't mix photos and documents in one album
+	sent := sender.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected a photo album and a document, got %+v", sent)
+	}
+	if group, ok := sent[0].(tgbotapi.MediaGroupConfig); !ok || len(group.Media) != 2 {
+		t.Errorf("expected the 2 photos as an album first, got %+v", sent[0])
+	}
+	if document, ok := sent[1].(tgbotapi.DocumentConfig); !ok || document.File != tgbotapi.FileID("vase_scan") {
+		t.Errorf("expected the image file sent as a document, got %+v", sent[1])
+	}
+}
+
+func TestLegacySessionPhotosLoad(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	// Drafts saved before photos had metadata hold plain file IDs
+	if _, err := dbConn.Exec(`INSERT INTO sessions (user_id, state, post_data) VALUES (730, ?, '{"photos":["a","b"]}')`, fsm.StatePhotos); err != nil {
+		t.Fatalf("Failed to insert session: %v", err)
+	}
+	loaded, err := db.NewSessionStore(dbConn).LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions failed: %v", err)
+	}
+	photos, ok := loaded[730].PostData["photos"].([]fsm.Photo)
+	if !ok || len(photos) != 2 || photos[1].FileID != "b" {
+		t.Errorf("expected legacy photos converted, got %#v", loaded[730].PostData["photos"])
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		text string
+		want bot.Price
+		ok   bool
+	}{
+		{"250", bot.Price{Kind: bot.PriceFixed, Amount: 25000, Currency: "CZK"}, true},
+		{"$42", bot.Price{Kind: bot.PriceFixed, Amount: 4200, Currency: "USD"}, true},
+		{"42 eur", bot.Price{Kind: bot.PriceFixed, Amount: 4200, Currency: "EUR"}, true},
+		{"15.5 €", bot.Price{Kind: bot.PriceFixed, Amount: 1550, Currency: "EUR"}, true},
+		{"1 500,50 Kč", bot.Price{Kind: bot.PriceFixed, Amount: 150050, Currency: "CZK"}, true},
+		{"1,500", bot.Price{Kind: bot.PriceFixed, Amount: 150000, Currency: "CZK"}, true},
+		{"1.500,- Kč", bot.Price{Kind: bot.PriceFixed, Amount: 150000, Currency: "CZK"}, true},
+		{"₪ 80", bot.Price{Kind: bot.PriceFixed, Amount: 8000, Currency: "ILS"}, true},
+		{"Free", bot.Price{Kind: bot.PriceFree}, true},
+		{"dohodou", bot.Price{Kind: bot.PriceNegotiable}, true},
+		{"לפי הצעה", bot.Price{Kind: bot.PriceNegotiable}, true},
+		{"abc", bot.Price{}, false},
+		{"42 dogs", bot.Price{}, false},
+		{"$42 eur", bot.Price{}, false},
+		{"1.234", bot.Price{Kind: bot.PriceFixed, Amount: 123400, Currency: "CZK"}, true},
+		{"1.2345", bot.Price{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := bot.ParsePrice(tt.text, "CZK")
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParsePrice(%q) = %+v, %v; want %+v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatPricePerLocale(t *testing.T) {
+	price := bot.Price{Kind: bot.PriceFixed, Amount: 150050, Currency: "CZK"}
+	tests := []struct {
+		lang string
+		want string
+	}{
+		{"en", "1,500.50 Kč"},
+		{"cz", "1\u00a0500,50 Kč"},
+		{"he", "\u20681,500.50\u2069 \u2068Kč\u2069"},
+	}
+	for _, tt := range tests {
+		if got := bot.FormatPrice(tt.lang, price); got != tt.want {
+			t.Errorf("FormatPrice(%s) = %q, want %q", tt.lang, got, tt.want)
+		}
+	}
+	if got := bot.FormatPrice("cz", bot.Price{Kind: bot.PriceFree}); got != "Zdarma" {
+		t.Errorf("expected Zdarma, got %q", got)
+	}
+}
+
+func TestInvalidPriceKeepsPriceStep(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	fsm.Delete(740)
+	for _, text := range []string{"/start", "Bike", "Desc"} {
+		bot.HandleMessageWithDB(dbConn, 740, text, sender, 740, 1, nil, -1001, "en")
+	}
+	resp := bot.HandleMessageWithDB(dbConn, 740, "cheap", sender, 740, 2, nil, -1001, "en")
+	session := mustSession(t, 740)
+	if session.State != fsm.StatePrice || !strings.HasPrefix(resp, "Please enter a price") {
+		t.Fatalf("expected to stay at the price step, got state=%d resp=%q", session.State, resp)
+	}
+	if _, ok := session.PostData["price"]; ok {
+		t.Errorf("invalid price must not be stored, got %v", session.PostData["price"])
+	}
+}
+
+func TestStructuredPriceStored(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	if err := db.SetConfig(dbConn, "DEFAULT_CURRENCY", "czk"); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 741, "Chair", "chair_1")
+
+	var text, currency, kind string
+	var amount int64
+	err := dbConn.QueryRow("SELECT price, price_amount, price_currency, price_kind FROM posts WHERE id = ?", postID).Scan(&text, &amount, &currency, &kind)
+	if err != nil {
+		t.Fatalf("Failed to read price: %v", err)
+	}
+	if text != "10" || amount != 1000 || currency != "CZK" || kind != bot.PriceFixed {
+		t.Errorf("unexpected stored price %q %d %q %q", text, amount, currency, kind)
+	}
+
+	sender.Reset()
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	photos := sender.Photos()
+	if len(photos) != 1 || !strings.Contains(photos[0].Caption, "Price: 10 Kč") {
+		t.Errorf("expected the listing priced in Kč, got %+v", photos)
+	}
+}
+
+func TestWizardFieldValidation(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	fsm.Delete(750)
+	bot.HandleMessageWithDB(dbConn, 750, "/start", sender, 750, 1, nil, -1001, "en")
+
+	tests := []struct {
+		name   string
+		text   string
+		photos []fsm.Photo
+		want   string
+	}{
+		{"sticker", "", nil, "Please type the title as a text message."},
+		{"whitespace", "   ", nil, "Please type the title as a text message."},
+		{"photo", "", testPhotos("t_1"), "Please type the title as a text message."},
+		{"too short", "TV", nil, "The title must be at least 3 characters long."},
+		{"too long", strings.Repeat("é", 101), nil, "The title can be at most 100 characters long; yours has 101."},
+		{"two lines", "Sofa\nand chair", nil, "The title must fit on one line."},
+	}
+	for _, tt := range tests {
+		resp := bot.HandleMessageWithDB(dbConn, 750, tt.text, sender, 750, 2, tt.photos, -1001, "en")
+		session := mustSession(t, 750)
+		if resp != tt.want || session.State != fsm.StateTitle {
+			t.Errorf("%s: got %q in state %d, want %q in StateTitle", tt.name, resp, session.State, tt.want)
+		}
+	}
+	if _, ok := mustSession(t, 750).PostData["title"]; ok {
+		t.Fatalf("rejected titles must not be stored")
+	}
+
+	resp := bot.HandleMessageWithDB(dbConn, 750, "  Sofa  ", sender, 750, 3, nil, -1001, "en")
+	session := mustSession(t, 750)
+	if resp != "Enter a description:" || session.PostData["title"] != "Sofa" {
+		t.Fatalf("expected trimmed title accepted, got %q title=%q", resp, session.PostData["title"])
+	}
+	// Descriptions may span several lines
+	bot.HandleMessageWithDB(dbConn, 750, "Grey\nthree seats", sender, 750, 4, nil, -1001, "en")
+	if session.State != fsm.StatePrice || session.PostData["description"] != "Grey\nthree seats" {
+		t.Errorf("expected multi-line description accepted, got state=%d", session.State)
+	}
+}
+
+func TestFieldLengthLimitsFromConfig(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	t.Setenv("ADMINS", "1")
+	bot.LoadAdminsFromEnv()
+	if resp := bot.HandleAdminCommand(dbConn, 1, "/config LOCATION_MAX_LENGTH 5"); resp != "Config updated: LOCATION_MAX_LENGTH = 5" {
+		t.Fatalf("unexpected /config reply %q", resp)
+	}
+	sender := &bottest.Recorder{}
+	fsm.Delete(751)
+	for _, text := range []string{"/start", "Lamp", "Desc", "10"} {
+		bot.HandleMessageWithDB(dbConn, 751, text, sender, 751, 1, nil, -1001, "cz")
+	}
+	resp := bot.HandleMessageWithDB(dbConn, 751, "Praha 5", sender, 751, 2, nil, -1001, "cz")
+	if want := "Místo může mít nejvýše 5 znaků, váš má 7."; resp != want || mustSession(t, 751).State != fsm.StateLocation {
+		t.Errorf("got %q, want %q at the location step", resp, want)
+	}
+
+	// A minimum above the maximum would lock everyone out; the defaults apply
+	if err := db.SetConfig(dbConn, "LOCATION_MIN_LENGTH", "50"); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	if limit := db.FieldLength(dbConn, "location"); limit != db.DefaultLengthLimits["location"] {
+		t.Errorf("expected default limits, got %+v", limit)
+	}
+}
+
+func TestMyListingsSold(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 760, "Sofa", "sofa_1", "sofa_2")
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	published, err := db.GetPublishedMessages(dbConn, postID)
+	if err != nil || len(published) != 2 || published[0].Kind != db.PublishedCaption || published[1].Kind != db.PublishedPhoto {
+		t.Fatalf("expected the captioned album recorded, got %+v (%v)", published, err)
+	}
+
+	sender.Reset()
+	bot.SendMyListings(dbConn, sender, 760, 760, "en")
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].Text != fmt.Sprintf("#%d Sofa\nPrice: 10 €\nStatus: published", postID) {
+		t.Fatalf("expected one listing summary, got %+v", msgs)
+	}
+	buttons := msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup).InlineKeyboard[0]
+	if len(buttons) != 3 || *buttons[1].CallbackData != fmt.Sprintf("sold:%d", postID) {
+		t.Fatalf("expected Edit, Sold and Withdraw buttons, got %+v", buttons)
+	}
+
+	// Only the seller may act on a listing
+	action, id, ok := bot.ParseListingCallback(*buttons[1].CallbackData)
+	if !ok || action != "sold" || id != postID {
+		t.Fatalf("failed to parse %q", *buttons[1].CallbackData)
+	}
+	if text, _ := bot.HandleListingAction(dbConn, sender, 761, action, id, -1001, -1002, "en"); text != "This listing no longer exists." {
+		t.Errorf("expected a stranger to be refused, got %q", text)
+	}
+
+	sender.Reset()
+	text, markup := bot.HandleListingAction(dbConn, sender, 760, action, id, -1001, -1002, "en")
+	if !strings.HasSuffix(text, "Status: sold") || markup != nil {
+		t.Errorf("expected sold summary without buttons, got %q %+v", text, markup)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one edit of the published listing, got %+v", sent)
+	}
+	edit, ok := sent[0].(tgbotapi.EditMessageCaptionConfig)
+	if !ok || edit.MessageID != published[0].MessageID || !strings.HasPrefix(edit.Caption, "SOLD\\!\nTitle: Sofa") {
+		t.Errorf("expected the caption edited to SOLD, got %+v", sent[0])
+	}
+	var status string
+	dbConn.QueryRow("SELECT status FROM posts WHERE id = ?", postID).Scan(&status)
+	if status != "sold" {
+		t.Errorf("expected status sold, got %q", status)
+	}
+}
+
+func TestWithdrawListing(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+
+	// A pending listing is withdrawn from the moderation group
+	pending := submitPost(t, dbConn, sender, 762, "Rug", "rug_1")
+	sender.Reset()
+	text, markup := bot.HandleListingAction(dbConn, sender, 762, "withdraw", pending, -1001, -1002, "en")
+	if !strings.HasSuffix(text, "Status: withdrawn") || markup != nil {
+		t.Errorf("unexpected reply %q %+v", text, markup)
+	}
+	if deletes := sender.Deletes(); len(deletes) != 2 || deletes[0].ChatID != -1001 {
+		t.Errorf("expected the moderation photo and keyboard deleted, got %+v", deletes)
+	}
+	if err := bot.ApprovePost(dbConn, sender, pending, -1002); err == nil {
+		t.Errorf("expected a withdrawn post not to be approvable")
+	}
+
+	// An approved one from the sale group
+	approved := submitPost(t, dbConn, sender, 762, "Lamp")
+	if err := bot.ApprovePost(dbConn, sender, approved, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	published, _ := db.GetPublishedMessages(dbConn, approved)
+	if len(published) != 1 || published[0].Kind != db.PublishedText {
+		t.Fatalf("expected the listing text recorded, got %+v", published)
+	}
+	sender.Reset()
+	bot.HandleListingAction(dbConn, sender, 762, "withdraw", approved, -1001, -1002, "en")
+	if deletes := sender.Deletes(); len(deletes) != 1 || deletes[0].ChatID != -1002 || deletes[0].MessageID != published[0].MessageID {
+		t.Errorf("expected the published listing deleted, got %+v", deletes)
+	}
+	if left, _ := db.GetPublishedMessages(dbConn, approved); len(left) != 0 {
+		t.Errorf("expected published messages forgotten, got %+v", left)
+	}
+
+	sender.Reset()
+	bot.SendMyListings(dbConn, sender, 762, 762, "en")
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].Text != "You have no listings yet. Send /start to create one." {
+		t.Errorf("expected withdrawn listings hidden, got %+v", msgs)
+	}
+}
+
+func TestRenewExpiredListing(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 763, "Desk", "desk_1")
+	if _, err := dbConn.Exec("UPDATE posts SET status = 'expired', expires_at = '2000-01-01 00:00:00' WHERE id = ?", postID); err != nil {
+		t.Fatalf("Failed to expire post: %v", err)
+	}
+
+	sender.Reset()
+	text, markup := bot.HandleListingAction(dbConn, sender, 763, "renew", postID, -1001, -1002, "en")
+	if !strings.HasSuffix(text, "Status: waiting for moderation") || markup == nil {
+		t.Fatalf("expected pending summary with Withdraw, got %q %+v", text, markup)
+	}
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != -1001 || !strings.HasPrefix(msgs[0].Text, "New Sale Post:\nTitle: Desk") {
+		t.Fatalf("expected the listing back in moderation, got %+v", msgs)
+	}
+	var expiresAt string
+	dbConn.QueryRow("SELECT expires_at FROM posts WHERE id = ?", postID).Scan(&expiresAt)
+	if expiresAt <= db.FormatTime(time.Now()) {
+		t.Errorf("expected a new moderation timeout, got %q", expiresAt)
+	}
+	if refs, _ := db.GetModerationMessages(dbConn, postID); len(refs) != 2 {
+		t.Errorf("expected only the new moderation bundle, got %+v", refs)
+	}
+	// Renewing twice does nothing
+	sender.Reset()
+	bot.HandleListingAction(dbConn, sender, 763, "renew", postID, -1001, -1002, "en")
+	if len(sender.Sent()) != 0 {
+		t.Errorf("expected no second moderation round, got %+v", sender.Sent())
+	}
+}
+
+func TestRenewSendFailureKeepsListingExpired(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := submitPost(t, dbConn, sender, 764, "Sofa", "sofa_1")
+	if _, err := dbConn.Exec("UPDATE posts SET status = 'expired', expires_at = '2000-01-01 00:00:00' WHERE id = ?", postID); err != nil {
+		t.Fatalf("Failed to expire post: %v", err)
+	}
+
+	sender.Reset()
+	sender.SendErr = fmt.Errorf("network down")
+	bot.HandleListingAction(dbConn, sender, 764, "renew", postID, -1001, -1002, "en")
+	if got := postStatus(t, dbConn, postID); got != "expired" {
+		t.Fatalf("expected the listing to stay expired when moderation can't be reached, got %q", got)
+	}
+
+	sender.SendErr = nil
+	sender.Reset()
+	bot.HandleListingAction(dbConn, sender, 764, "renew", postID, -1001, -1002, "en")
+	if got := postStatus(t, dbConn, postID); got != "pending" {
+		t.Errorf("expected the retry to renew the listing, got %q", got)
+	}
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].ChatID != -1001 {
+		t.Errorf("expected the retry to reach the moderators, got %+v", msgs)
+	}
+}
+
+// startEdit approves a fresh listing of userID and opens it for editing,
+// returning the post ID.
+func startEdit(t *testing.T, dbConn *sql.DB, sender *bottest.Recorder, userID int64, title string, photos ...string) int64 {
+	t.Helper()
+	postID := submitPost(t, dbConn, sender, userID, title, photos...)
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	text, markup := bot.HandleListingAction(dbConn, sender, userID, "edit_listing", postID, -1001, -1002, "en")
+	session := mustSession(t, userID)
+	if !strings.HasPrefix(text, "Preview:\nTitle: "+title) || session.State != fsm.StatePreview {
+		t.Fatalf("expected the listing's preview, got %q in state %d", text, session.State)
+	}
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if *button.CallbackData == "edit:photos" {
+				t.Errorf("published photos can't be changed, but the preview offers it")
+			}
+		}
+	}
+	return postID
+}
+
+func TestEditListingPriceAppliedDirectly(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 770, "Sofa", "sofa_1")
+	published, _ := db.GetPublishedMessages(dbConn, postID)
+
+	bot.HandleMessageWithDB(dbConn, 770, "edit:price", sender, 770, 5, nil, -1001, "en")
+	resp := bot.HandleMessageWithDB(dbConn, 770, "25 eur", sender, 770, 6, nil, -1001, "en")
+	if !strings.Contains(resp, "Price: 25 €") {
+		t.Fatalf("expected the preview with the new price, got %q", resp)
+	}
+	sender.Reset()
+	resp = bot.HandleMessageWithDB(dbConn, 770, "confirm", sender, 770, 7, nil, -1001, "en")
+	if resp != "The new price is now shown in your listing." || mustSession(t, 770).State != fsm.StateIdle {
+		t.Fatalf("unexpected reply %q", resp)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected only the published caption edited, got %+v", sent)
+	}
+	edit, ok := sent[0].(tgbotapi.EditMessageCaptionConfig)
+	if !ok || edit.MessageID != published[0].MessageID || !strings.Contains(edit.Caption, "Price: 25 €") {
+		t.Errorf("expected the caption edited with the new price, got %+v", sent[0])
+	}
+	var amount int64
+	dbConn.QueryRow("SELECT price_amount FROM posts WHERE id = ?", postID).Scan(&amount)
+	if amount != 2500 {
+		t.Errorf("expected the new price stored, got %d", amount)
+	}
+}
+
+func TestEditListingGoesThroughModeration(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 771, "Lamp")
+
+	bot.HandleMessageWithDB(dbConn, 771, "edit:title", sender, 771, 5, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 771, "Desk lamp", sender, 771, 6, nil, -1001, "en")
+	sender.Reset()
+	resp := bot.HandleMessageWithDB(dbConn, 771, "confirm", sender, 771, 7, nil, -1001, "en")
+	if !strings.HasPrefix(resp, "Your changes were sent for moderation.") {
+		t.Fatalf("unexpected reply %q", resp)
+	}
+	msgs := sender.Messages()
+	want := fmt.Sprintf("✏️ Edit request for listing #%d (Lamp):\nTitle:\n− Lamp\n+ Desk lamp", postID)
+	if len(msgs) != 1 || msgs[0].ChatID != -1001 || msgs[0].Text != want {
+		t.Fatalf("expected the diff in the moderation group, got %+v", msgs)
+	}
+	data := *msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup).InlineKeyboard[0][0].CallbackData
+	action, editID, ok := bot.ParseEditCallback(data)
+	if !ok || action != "approve_edit" {
+		t.Fatalf("unexpected edit button %q", data)
+	}
+	var title string
+	dbConn.QueryRow("SELECT title FROM posts WHERE id = ?", postID).Scan(&title)
+	if title != "Lamp" {
+		t.Errorf("expected the listing unchanged until approval, got %q", title)
+	}
+
+	sender.Reset()
+	if err := bot.ApproveEdit(dbConn, sender, editID); err != nil {
+		t.Fatalf("ApproveEdit failed: %v", err)
+	}
+	dbConn.QueryRow("SELECT title FROM posts WHERE id = ?", postID).Scan(&title)
+	if title != "Desk lamp" {
+		t.Errorf("expected the new title stored, got %q", title)
+	}
+	var edited, notified bool
+	for _, c := range sender.Sent() {
+		switch m := c.(type) {
+		case tgbotapi.EditMessageTextConfig:
+			edited = m.ChatID == -1002 && strings.Contains(m.Text, "Title: Desk lamp")
+		case tgbotapi.MessageConfig:
+			notified = m.ChatID == 771 && strings.Contains(m.Text, "were approved")
+		}
+	}
+	if !edited || !notified {
+		t.Errorf("expected the published text edited and the seller told, got %+v", sender.Sent())
+	}
+	if err := bot.ApproveEdit(dbConn, sender, editID); !errors.Is(err, db.ErrEditNotPending) {
+		t.Errorf("expected a second approval to fail, got %v", err)
+	}
+}
+
+func TestEditListingSupersedeAndReject(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 772, "Chair")
+	bot.HandleMessageWithDB(dbConn, 772, "edit:location", sender, 772, 5, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 772, "Ostrava", sender, 772, 6, nil, -1001, "en")
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, 772, "confirm", sender, 772, 7, nil, -1001, "en")
+	first := sender.Messages()[0]
+
+	// A draft in progress is never overwritten by an edit
+	bot.HandleMessageWithDB(dbConn, 772, "/start", sender, 772, 8, nil, -1001, "en")
+	if text, _ := bot.HandleListingAction(dbConn, sender, 772, "edit_listing", postID, -1001, -1002, "en"); text != "Finish or /cancel the post you are writing first." {
+		t.Errorf("expected the edit refused during a draft, got %q", text)
+	}
+	if resp := bot.HandleMessageWithDB(dbConn, 772, "/cancel", sender, 772, 9, nil, -1001, "en"); resp != "Post creation cancelled." {
+		t.Errorf("unexpected /cancel reply %q", resp)
+	}
+
+	bot.HandleListingAction(dbConn, sender, 772, "edit_listing", postID, -1001, -1002, "en")
+	bot.HandleMessageWithDB(dbConn, 772, "edit:location", sender, 772, 10, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 772, "Olomouc", sender, 772, 11, nil, -1001, "en")
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, 772, "confirm", sender, 772, 12, nil, -1001, "en")
+	if deletes := sender.Deletes(); len(deletes) != 1 || deletes[0].MessageID != 1 || first.ChatID != -1001 {
+		t.Errorf("expected the superseded request deleted, got %+v", deletes)
+	}
+	data := *sender.Messages()[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup).InlineKeyboard[0][1].CallbackData
+	action, editID, _ := bot.ParseEditCallback(data)
+	if action != "reject_edit" {
+		t.Fatalf("unexpected button %q", data)
+	}
+	sender.Reset()
+	if err := bot.RejectEdit(dbConn, sender, editID); err != nil {
+		t.Fatalf("RejectEdit failed: %v", err)
+	}
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].Text != `Your changes to "Chair" were rejected; the listing is unchanged.` {
+		t.Errorf("expected the seller told, got %+v", msgs)
+	}
+	var location string
+	dbConn.QueryRow("SELECT location FROM posts WHERE id = ?", postID).Scan(&location)
+	if location != "Brno" {
+		t.Errorf("expected the location unchanged, got %q", location)
+	}
+
+	// Cancelling an edit leaves the listing alone
+	bot.HandleListingAction(dbConn, sender, 772, "edit_listing", postID, -1001, -1002, "en")
+	if resp := bot.HandleMessageWithDB(dbConn, 772, "cancel", sender, 772, 13, nil, -1001, "en"); resp != "Changes discarded; your listing is unchanged." {
+		t.Errorf("unexpected cancel reply %q", resp)
+	}
+}
+
+// requestLocationEdit has userID change the location of published post
+// postID and returns the ID of the resulting edit request.
+func requestLocationEdit(t *testing.T, dbConn *sql.DB, sender *bottest.Recorder, userID, postID int64, location string) int64 {
+	t.Helper()
+	bot.HandleListingAction(dbConn, sender, userID, "edit_listing", postID, -1001, -1002, "en")
+	bot.HandleMessageWithDB(dbConn, userID, "edit:location", sender, userID, 20, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, userID, location, sender, userID, 21, nil, -1001, "en")
+	sender.Reset()
+	bot.HandleMessageWithDB(dbConn, userID, "confirm", sender, userID, 22, nil, -1001, "en")
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != -1001 {
+		t.Fatalf("expected an edit request to the moderators, got %+v", msgs)
+	}
+	_, editID, ok := bot.ParseEditCallback(*msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup).InlineKeyboard[0][0].CallbackData)
+	if !ok {
+		t.Fatalf("expected edit request buttons, got %+v", msgs[0].ReplyMarkup)
+	}
+	return editID
+}
+
+func postPriceAndLocation(t *testing.T, dbConn *sql.DB, postID int64) (int64, string) {
+	t.Helper()
+	var amount int64
+	var location string
+	if err := dbConn.QueryRow("SELECT price_amount, location FROM posts WHERE id = ?", postID).Scan(&amount, &location); err != nil {
+		t.Fatalf("Failed to read post %d: %v", postID, err)
+	}
+	return amount, location
+}
+
+func TestEditApprovalOnlyAppliesChangedFields(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 773, "Lamp")
+	bot.HandleMessageWithDB(dbConn, 773, "cancel", sender, 773, 5, nil, -1001, "en")
+	editID := requestLocationEdit(t, dbConn, sender, 773, postID, "Plzeň")
+
+	// A direct price change retires the pending request
+	bot.HandleListingAction(dbConn, sender, 773, "edit_listing", postID, -1001, -1002, "en")
+	bot.HandleMessageWithDB(dbConn, 773, "edit:price", sender, 773, 30, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 773, "5", sender, 773, 31, nil, -1001, "en")
+	sender.Reset()
+	resp := bot.HandleMessageWithDB(dbConn, 773, "confirm", sender, 773, 32, nil, -1001, "en")
+	if !strings.HasPrefix(resp, "The new price is now shown") || !strings.Contains(resp, "were discarded") {
+		t.Errorf("expected the seller told about the discarded request, got %q", resp)
+	}
+	if deletes := sender.Deletes(); len(deletes) != 1 || deletes[0].ChatID != -1001 {
+		t.Errorf("expected the edit request removed from moderation, got %+v", deletes)
+	}
+	if err := bot.ApproveEdit(dbConn, sender, editID); !errors.Is(err, db.ErrEditNotPending) {
+		t.Errorf("expected the superseded request to be refused, got %v", err)
+	}
+
+	// A request only carries the fields it changed
+	editID = requestLocationEdit(t, dbConn, sender, 773, postID, "Plzeň")
+	if err := db.UpdatePostFields(dbConn, postID, map[string]interface{}{"price": "7", "price_amount": int64(700), "price_currency": "EUR", "price_kind": bot.PriceFixed}, []string{"price"}); err != nil {
+		t.Fatalf("UpdatePostFields failed: %v", err)
+	}
+	if err := bot.ApproveEdit(dbConn, sender, editID); err != nil {
+		t.Fatalf("ApproveEdit failed: %v", err)
+	}
+	if amount, location := postPriceAndLocation(t, dbConn, postID); amount != 700 || location != "Plzeň" {
+		t.Errorf("expected the new location with the later price, got %d %q", amount, location)
+	}
+}
+
+func TestEditApprovalRefusedForSoldListing(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 774, "Rug")
+	bot.HandleMessageWithDB(dbConn, 774, "cancel", sender, 774, 5, nil, -1001, "en")
+	editID := requestLocationEdit(t, dbConn, sender, 774, postID, "Kladno")
+	bot.HandleListingAction(dbConn, sender, 774, "sold", postID, -1001, -1002, "en")
+	sender.Reset()
+
+	if err := bot.ApproveEdit(dbConn, sender, editID); !errors.Is(err, bot.ErrEditStale) {
+		t.Fatalf("expected ErrEditStale, got %v", err)
+	}
+	if len(sender.Sent()) != 0 {
+		t.Errorf("expected the sold listing and the seller left alone, got %+v", sender.Sent())
+	}
+	if _, location := postPriceAndLocation(t, dbConn, postID); location != "Brno" {
+		t.Errorf("expected the location unchanged, got %q", location)
+	}
+	var status string
+	dbConn.QueryRow("SELECT status FROM listing_edits WHERE id = ?", editID).Scan(&status)
+	if status != "stale" {
+		t.Errorf("expected the request marked stale, got %q", status)
+	}
+}
+
+// moderateEdit presses an edit request button in the moderation group and
+// returns the text the moderation message was replaced with.
+func moderateEdit(t *testing.T, dbConn *sql.DB, sender *bottest.Recorder, action string, editID int64) string {
+	t.Helper()
+	sender.Reset()
+	handleUpdate(dbConn, sender, newAlbumAcks(sender, time.Millisecond), tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		From:    &tgbotapi.User{ID: 42},
+		Message: &tgbotapi.Message{MessageID: 30, Chat: &tgbotapi.Chat{ID: -1001}},
+		Data:    fmt.Sprintf("%s:%d", action, editID),
+	}}, -1001, -1002)
+	var text string
+	for _, c := range sender.Sent() {
+		if e, ok := c.(tgbotapi.EditMessageTextConfig); ok && e.ChatID == -1001 && e.MessageID == 30 {
+			text = e.Text
+		}
+	}
+	return text
+}
+
+func TestEditCallbackAlreadyDecided(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID := startEdit(t, dbConn, sender, 776, "Shelf")
+	bot.HandleMessageWithDB(dbConn, 776, "cancel", sender, 776, 5, nil, -1001, "en")
+	editID := requestLocationEdit(t, dbConn, sender, 776, postID, "Olomouc")
+
+	if got := moderateEdit(t, dbConn, sender, "approve_edit", editID); got != "✅ Edit approved and applied." {
+		t.Fatalf("unexpected approval text: %q", got)
+	}
+	// A late reject or a double tap doesn't pretend to decide again
+	const decided = "This edit request was already decided."
+	if got := moderateEdit(t, dbConn, sender, "reject_edit", editID); got != decided {
+		t.Errorf("expected the late reject to say so, got %q", got)
+	}
+	if got := moderateEdit(t, dbConn, sender, "approve_edit", editID); got != decided {
+		t.Errorf("expected the double tap to say so, got %q", got)
+	}
+	if _, location := postPriceAndLocation(t, dbConn, postID); location != "Olomouc" {
+		t.Errorf("expected the approved edit to stay applied, got %q", location)
+	}
+}
+
+func TestEditRequestSendFailureKeepsChanges(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	startEdit(t, dbConn, sender, 775, "Mirror")
+	bot.HandleMessageWithDB(dbConn, 775, "edit:location", sender, 775, 5, nil, -1001, "en")
+	bot.HandleMessageWithDB(dbConn, 775, "Zlín", sender, 775, 6, nil, -1001, "en")
+	sender.SendErr = fmt.Errorf("network down")
+	resp := bot.HandleMessageWithDB(dbConn, 775, "confirm", sender, 775, 7, nil, -1001, "en")
+	if resp != "Your changes could not be sent to the moderators and were not saved. Please press Confirm to try again." {
+		t.Errorf("unexpected response: %q", resp)
+	}
+	var count int
+	dbConn.QueryRow("SELECT COUNT(*) FROM listing_edits").Scan(&count)
+	if session := mustSession(t, 775); count != 0 || session.State != fsm.StatePreview || session.PostData["location"] != "Zlín" {
+		t.Fatalf("expected no request left and the changes kept, got %d requests, state %d", count, session.State)
+	}
+
+	sender.SendErr = nil
+	if resp := bot.HandleMessageWithDB(dbConn, 775, "confirm", sender, 775, 8, nil, -1001, "en"); !strings.HasPrefix(resp, "Your changes were sent for moderation") {
+		t.Errorf("expected the retry to reach the moderators, got %q", resp)
+	}
+	dbConn.QueryRow("SELECT COUNT(*) FROM listing_edits WHERE status = 'pending' AND moderation_message_id IS NOT NULL").Scan(&count)
+	if count != 1 {
+		t.Errorf("expected one pending request linked to its message, got %d", count)
+	}
+}
+
+// publishForLifetime approves a fresh listing of userID with two photos and
+// returns its ID and the time the lifetime started at.
+func publishForLifetime(t *testing.T, dbConn *sql.DB, sender *bottest.Recorder, userID int64, title string) (int64, time.Time) {
+	t.Helper()
+	postID := submitPost(t, dbConn, sender, userID, title, "photo_a", "photo_b")
+	sender.Reset()
+	if err := bot.ApprovePost(dbConn, sender, postID, -1002); err != nil {
+		t.Fatalf("ApprovePost failed: %v", err)
+	}
+	var end time.Time
+	if err := dbConn.QueryRow("SELECT listing_expires_at FROM posts WHERE id = ?", postID).Scan(&end); err != nil {
+		t.Fatalf("Failed to read listing lifetime: %v", err)
+	}
+	sender.Reset()
+	return postID, end.Add(-db.ListingLifetime(dbConn))
+}
+
+func TestListingLifetimeRemindsAndExpires(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	db.SetConfig(dbConn, "LISTING_LIFETIME_DAYS", "10")
+	postID, start := publishForLifetime(t, dbConn, sender, 780, "Bike")
+
+	if n, _ := bot.ExpireListings(dbConn, sender, start.Add(time.Hour)); n != 0 || len(sender.Sent()) != 0 {
+		t.Fatalf("expected nothing to do early on, got %d %+v", n, sender.Sent())
+	}
+	// Three days before the end, the default reminder time
+	bot.ExpireListings(dbConn, sender, start.Add(7*24*time.Hour+time.Minute))
+	msgs := sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != 780 || msgs[0].Text != "Your listing \"Bike\" will be taken down from the sale group in 3 days. Renew it to keep it up, or mark it sold." {
+		t.Fatalf("expected a reminder to the seller, got %+v", msgs)
+	}
+	markup, ok := msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || len(markup.InlineKeyboard[0]) != 2 || *markup.InlineKeyboard[0][0].CallbackData != fmt.Sprintf("renew:%d", postID) || *markup.InlineKeyboard[0][1].CallbackData != fmt.Sprintf("sold:%d", postID) {
+		t.Errorf("expected Renew and Sold buttons, got %+v", msgs[0].ReplyMarkup)
+	}
+	sender.Reset()
+	bot.ExpireListings(dbConn, sender, start.Add(8*24*time.Hour))
+	if len(sender.Sent()) != 0 {
+		t.Errorf("expected only one reminder, got %+v", sender.Sent())
+	}
+
+	n, err := bot.ExpireListings(dbConn, sender, start.Add(10*24*time.Hour+time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("expected one expired listing, got %d, %v", n, err)
+	}
+	if status := postStatus(t, dbConn, postID); status != "expired" {
+		t.Errorf("expected status expired, got %q", status)
+	}
+	deletes := sender.Deletes()
+	if len(deletes) != 2 || deletes[0].ChatID != -1002 || deletes[0].MessageID != 1 || deletes[1].MessageID != 2 {
+		t.Errorf("expected the published album to be deleted, got %+v", deletes)
+	}
+	if published, _ := db.GetPublishedMessages(dbConn, postID); len(published) != 0 {
+		t.Errorf("expected no published messages left, got %+v", published)
+	}
+	msgs = sender.Messages()
+	if len(msgs) != 1 || msgs[0].ChatID != 780 || !strings.HasPrefix(msgs[0].Text, "Your listing \"Bike\" has expired") {
+		t.Fatalf("expected the seller to be told, got %+v", msgs)
+	}
+	if markup, ok := msgs[0].ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); !ok || *markup.InlineKeyboard[0][0].CallbackData != fmt.Sprintf("renew:%d", postID) {
+		t.Errorf("expected a Renew button, got %+v", msgs[0].ReplyMarkup)
+	}
+}
+
+func TestRenewBeforeExpiryExtendsLifetime(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID, _ := publishForLifetime(t, dbConn, sender, 781, "Tent")
+	// Two days left, and the seller was reminded
+	soon := time.Now().Add(48 * time.Hour)
+	if _, err := dbConn.Exec("UPDATE posts SET listing_expires_at = ? WHERE id = ?", db.FormatTime(soon), postID); err != nil {
+		t.Fatalf("Failed to shorten lifetime: %v", err)
+	}
+	bot.ExpireListings(dbConn, sender, time.Now())
+	if len(sender.Messages()) != 1 {
+		t.Fatalf("expected a reminder, got %+v", sender.Sent())
+	}
+	sender.Reset()
+
+	text, _ := bot.HandleListingAction(dbConn, sender, 781, "renew", postID, -1001, -1002, "en")
+	if !strings.HasSuffix(text, "Status: published") {
+		t.Errorf("expected the listing to stay published, got %q", text)
+	}
+	if len(sender.Sent()) != 0 {
+		t.Errorf("expected nothing sent for an extension, got %+v", sender.Sent())
+	}
+	var expiresAt time.Time
+	var reminded sql.NullTime
+	dbConn.QueryRow("SELECT listing_expires_at, reminded_at FROM posts WHERE id = ?", postID).Scan(&expiresAt, &reminded)
+	if !expiresAt.After(soon.Add(24*time.Hour)) || reminded.Valid {
+		t.Errorf("expected a new lifetime with a new reminder, got %q reminded %v", expiresAt, reminded)
+	}
+}
+
+func TestExpiredListingStruckThroughAndRepublished(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	db.SetConfig(dbConn, "LISTING_EXPIRY_ACTION", bot.ListingExpiryStrike)
+	postID, start := publishForLifetime(t, dbConn, sender, 782, "Kayak")
+
+	bot.ExpireListings(dbConn, sender, start.Add(31*24*time.Hour))
+	var caption *tgbotapi.EditMessageCaptionConfig
+	for _, c := range sender.Sent() {
+		if e, ok := c.(tgbotapi.EditMessageCaptionConfig); ok {
+			caption = &e
+		}
+	}
+	if caption == nil || caption.MessageID != 1 || !strings.HasPrefix(caption.Caption, "~FOR SALE\\!") || !strings.HasSuffix(caption.Caption, "~") {
+		t.Fatalf("expected the caption to be struck through, got %+v", caption)
+	}
+	if len(sender.Deletes()) != 0 {
+		t.Errorf("expected nothing deleted, got %+v", sender.Deletes())
+	}
+
+	// Renewing publishes it again without moderation and drops the old album
+	sender.Reset()
+	text, _ := bot.HandleListingAction(dbConn, sender, 782, "renew", postID, -1001, -1002, "en")
+	if !strings.HasSuffix(text, "Status: published") {
+		t.Errorf("expected the listing to be published again, got %q", text)
+	}
+	groups := sender.MediaGroups()
+	if len(groups) != 1 || groups[0].ChatID != -1002 || len(sender.Messages()) != 0 {
+		t.Fatalf("expected a new album in the sale group only, got %+v", sender.Sent())
+	}
+	deletes := sender.Deletes()
+	if len(deletes) != 2 || deletes[0].ChatID != -1002 || deletes[0].MessageID != 1 || deletes[1].MessageID != 2 {
+		t.Errorf("expected the struck-through album to be deleted, got %+v", deletes)
+	}
+	if published, _ := db.GetPublishedMessages(dbConn, postID); len(published) != 2 {
+		t.Errorf("expected the new album on record, got %+v", published)
+	}
+}
+
+func TestSoldListingExpiresOnce(t *testing.T) {
+	dbConn := setupTestDB(t)
+	defer dbConn.Close()
+	sender := &bottest.Recorder{}
+	postID, start := publishForLifetime(t, dbConn, sender, 783, "Skis")
+	bot.HandleListingAction(dbConn, sender, 783, "sold", postID, -1001, -1002, "en")
+	sender.Reset()
+
+	if n, _ := bot.ExpireListings(dbConn, sender, start.Add(31*24*time.Hour)); n != 1 {
+		t.Fatalf("expected the sold listing to be taken down, got %d", n)
+	}
+	if status := postStatus(t, dbConn, postID); status != "sold" {
+		t.Errorf("expected status sold, got %q", status)
+	}
+	if len(sender.Deletes()) != 2 || len(sender.Messages()) != 0 {
+		t.Errorf("expected the album deleted without telling the seller, got %+v", sender.Sent())
+	}
+	if n, _ := bot.ExpireListings(dbConn, sender, start.Add(32*24*time.Hour)); n != 0 {
+		t.Errorf("expected a sold listing to be taken down once, got %d", n)
 	}
 }